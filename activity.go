@@ -0,0 +1,76 @@
+package main
+
+import (
+	"hash/fnv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelActivity counts messages of a channel within one metrics interval
+type channelActivity struct {
+	messages int
+	// Hashes of the authors, only kept until the next metrics tick
+	authors map[uint64]bool
+}
+
+// recordMessage counts a message for the channel activity metrics
+func (bot *AwakenBot) recordMessage(guildID string, channelID string, authorID string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(authorID))
+
+	bot.channelActivityMutex.Lock()
+	if bot.channelActivity[guildID] == nil {
+		bot.channelActivity[guildID] = make(map[string]*channelActivity)
+	}
+
+	activity, ok := bot.channelActivity[guildID][channelID]
+	if !ok {
+		activity = &channelActivity{authors: make(map[uint64]bool)}
+		bot.channelActivity[guildID][channelID] = activity
+	}
+
+	activity.messages++
+	activity.authors[hash.Sum64()] = true
+	bot.channelActivityMutex.Unlock()
+}
+
+// metricChannels sends the activity of all text channels since the last tick
+func (bot *AwakenBot) metricChannels(s *discordgo.Session, g *discordgo.Guild) {
+	bot.channelActivityMutex.Lock()
+	activities := bot.channelActivity[g.ID]
+	delete(bot.channelActivity, g.ID)
+	bot.channelActivityMutex.Unlock()
+
+	s.State.RLock()
+	channels := make([]discordgo.Channel, 0, len(g.Channels))
+	for _, channel := range g.Channels {
+		if channel.Type == discordgo.ChannelTypeGuildText {
+			channels = append(channels, *channel)
+		}
+	}
+	s.State.RUnlock()
+
+	for _, channel := range channels {
+		category := ""
+		if channel.ParentID != "" {
+			if parent, err := s.State.Channel(channel.ParentID); err == nil {
+				category = parent.Name
+			}
+		}
+
+		messages, authors := 0, 0
+		if activity, ok := activities[channel.ID]; ok {
+			messages = activity.messages
+			authors = len(activity.authors)
+			bot.recordChannelMessages(g.ID, channel.ID, messages)
+		}
+
+		tags := map[string]string{"metric": "channel_messages", "server": g.Name, "channel": channel.Name, "category": category}
+		fields := map[string]interface{}{
+			"messages": messages,
+			"authors":  authors,
+		}
+
+		bot.addMetric("discord_metrics", tags, fields)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+)
+
+// jobStatus is the JSON representation of a job
+type jobStatus struct {
+	ID         int64      `json:"id"`
+	Type       string     `json:"type"`
+	Guild      string     `json:"guild"`
+	Payload    string     `json:"payload,omitempty"`
+	State      string     `json:"state"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	RunAt      time.Time  `json:"runAt"`
+	// Seconds between queuing and starting the last attempt
+	WaitSeconds float64 `json:"waitSeconds,omitempty"`
+	// Seconds between starting the last attempt and finishing
+	RunSeconds float64 `json:"runSeconds,omitempty"`
+}
+
+// Maximum amount of jobs returned by a list request
+const jobsListLimit = 100
+
+func (bot *AwakenBot) newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/healthz", bot.countRequests(http.HandlerFunc(bot.healthz))).Methods("GET")
+	r.HandleFunc("/readyz", bot.countRequests(http.HandlerFunc(bot.readyz))).Methods("GET")
+	if bot.prometheus != nil {
+		r.HandleFunc("/metrics", bot.countRequests(bot.prometheus)).Methods("GET")
+	}
+	r.HandleFunc("/api/refresh/{guild}/{id}", bot.authorize(scopeRefresh, bot.refresh)).Methods("POST")
+	r.HandleFunc("/api/refreshNicks/{guild}", bot.authorize(scopeRefresh, bot.refreshNicks)).Methods("POST")
+	r.HandleFunc("/api/refresh/{id}", bot.authorize(scopeRefresh, bot.refresh)).Methods("POST")
+	r.HandleFunc("/api/refreshNicks", bot.authorize(scopeRefresh, bot.refreshNicks)).Methods("POST")
+	r.HandleFunc("/api/jobs", bot.authorize(scopeJobs, bot.listJobs)).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}", bot.authorize(scopeJobs, bot.getJob)).Methods("GET")
+	r.HandleFunc("/api/guilds/{guild}/members/{discordID}", bot.authorize(scopeRead, bot.getMember)).Methods("GET")
+	r.HandleFunc("/api/guilds/{guild}/roles/{slug}/members", bot.authorize(scopeRead, bot.getRoleMembers)).Methods("GET")
+
+	r.MethodNotAllowedHandler = bot.countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}))
+	r.NotFoundHandler = bot.countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "Not found")
+	}))
+
+	return r
+}
+
+// writeJSON sends a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Errorln("Could not write JSON response", err.Error())
+	}
+}
+
+// writeError sends a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// enqueueRequest queues the jobs of a request and responds with their IDs
+func (bot *AwakenBot) enqueueRequest(w http.ResponseWriter, jobs []botJob) {
+	queued := []map[string]interface{}{}
+	for _, job := range jobs {
+		q, err := bot.enqueue(job)
+		if err == errQueueFull {
+			w.Header().Set("Retry-After", strconv.Itoa(jobRetryAfter))
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"error": err.Error(),
+				"jobs":  queued,
+			})
+			return
+		}
+
+		queued = append(queued, map[string]interface{}{
+			"id":    q.id,
+			"type":  q.job.Type(),
+			"guild": q.job.Guild(),
+		})
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"jobs": queued})
+}
+
+func (bot *AwakenBot) refreshNicks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	log.Debugln("HTTP request refreshNicks, guild:", vars["guild"])
+
+	jobs := []botJob{}
+	for _, guildID := range bot.requestGuilds(r) {
+		jobs = append(jobs, refreshNicksJob{guildID: guildID})
+	}
+
+	bot.enqueueRequest(w, jobs)
+}
+
+func (bot *AwakenBot) refresh(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	log.Debugln("HTTP request refresh, id:", vars["id"], "guild:", vars["guild"])
+
+	jobs := []botJob{}
+	if vars["id"] == "all" {
+		for _, guildID := range bot.requestGuilds(r) {
+			jobs = append(jobs, refreshAllJob{guildID: guildID})
+		}
+
+		bot.enqueueRequest(w, jobs)
+		return
+	}
+
+	guildIDs := []string{vars["guild"]}
+	if vars["guild"] == "" {
+		guilds, err := bot.memberGuilds(vars["id"], bot.DG)
+		if err == errMembersLoading {
+			w.Header().Set("Retry-After", strconv.Itoa(jobRetryAfter))
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		guildIDs = []string{}
+		for _, guild := range guilds {
+			if requestKey(r).allowsGuild(guild.ID) {
+				guildIDs = append(guildIDs, guild.ID)
+			}
+		}
+	}
+
+	for _, guildID := range guildIDs {
+		jobs = append(jobs, refreshJob{guildID: guildID, discordID: vars["id"]})
+	}
+
+	bot.enqueueRequest(w, jobs)
+}
+
+// requestGuilds returns the guild of a request or all managed guilds the
+// API key may use if the route has no guild
+func (bot *AwakenBot) requestGuilds(r *http.Request) []string {
+	if guildID := mux.Vars(r)["guild"]; guildID != "" {
+		return []string{guildID}
+	}
+
+	guildIDs := []string{}
+	for _, guild := range bot.managedGuilds(bot.DG) {
+		if requestKey(r).allowsGuild(guild.ID) {
+			guildIDs = append(guildIDs, guild.ID)
+		}
+	}
+
+	return guildIDs
+}
+
+func (bot *AwakenBot) getJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid job id")
+		return
+	}
+
+	status, err := scanJobStatus(bot.GetJobByID.QueryRow(id))
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Unknown job")
+		return
+	}
+	if err != nil {
+		log.Errorln("Could not get job", id, err.Error())
+		writeError(w, http.StatusInternalServerError, "Could not get job")
+		return
+	}
+
+	if !requestKey(r).allowsGuild(status.Guild) {
+		writeError(w, http.StatusForbidden, "API key is not allowed for this guild")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (bot *AwakenBot) listJobs(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", jobScheduled, jobQueued, jobRunning, jobRetrying, jobSucceeded, jobFailed, jobCancelled:
+	default:
+		writeError(w, http.StatusBadRequest, "Invalid state")
+		return
+	}
+
+	rows, err := bot.GetJobsByState.Query(state, state, jobsListLimit)
+	if err != nil {
+		log.Errorln("Could not list jobs", err.Error())
+		writeError(w, http.StatusInternalServerError, "Could not list jobs")
+		return
+	}
+	defer rows.Close()
+
+	jobs := []*jobStatus{}
+	for rows.Next() {
+		status, err := scanJobStatus(rows)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		if !requestKey(r).allowsGuild(status.Guild) {
+			continue
+		}
+
+		jobs = append(jobs, status)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": jobs})
+}
+
+// rowScanner is implemented by sql.Row and sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanJobStatus reads a row of bot_jobs
+func scanJobStatus(row rowScanner) (*jobStatus, error) {
+	var status jobStatus
+	var lastError sql.NullString
+	var createdAt, runAt int64
+	var startedAt, finishedAt sql.NullInt64
+
+	err := row.Scan(&status.ID, &status.Type, &status.Guild, &status.Payload, &status.State, &status.Attempts, &lastError, &createdAt, &startedAt, &finishedAt, &runAt)
+	if err != nil {
+		return nil, err
+	}
+
+	status.Error = lastError.String
+	status.CreatedAt = time.Unix(createdAt, 0)
+	status.RunAt = time.Unix(runAt, 0)
+	if startedAt.Valid {
+		started := time.Unix(startedAt.Int64, 0)
+		status.StartedAt = &started
+		status.WaitSeconds = started.Sub(status.CreatedAt).Seconds()
+	}
+	if finishedAt.Valid {
+		finished := time.Unix(finishedAt.Int64, 0)
+		status.FinishedAt = &finished
+		if status.StartedAt != nil {
+			status.RunSeconds = finished.Sub(*status.StartedAt).Seconds()
+		}
+	}
+
+	return &status, nil
+}
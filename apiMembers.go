@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Members per page if the request does not ask for something else
+	membersPerPage = 100
+	// Maximum members per page
+	membersPerPageLimit = 1000
+)
+
+// memberRole is the JSON representation of a role of a member
+type memberRole struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug,omitempty"`
+}
+
+// memberInfo is the JSON representation of a cached guild member
+type memberInfo struct {
+	ID            string       `json:"id"`
+	Username      string       `json:"username"`
+	Discriminator string       `json:"discriminator"`
+	Nick          string       `json:"nick,omitempty"`
+	JoinedAt      string       `json:"joinedAt"`
+	Status        string       `json:"status"`
+	Game          string       `json:"game,omitempty"`
+	Roles         []memberRole `json:"roles"`
+}
+
+// newMemberInfo builds the JSON representation of a member from the caches
+func (bot *AwakenBot) newMemberInfo(guildID string, member *discordgo.Member) *memberInfo {
+	slugs := make(map[string]string)
+	for slug, roleID := range bot.rolesToIDMap[guildID] {
+		slugs[roleID] = slug
+	}
+
+	info := &memberInfo{
+		ID:            member.User.ID,
+		Username:      member.User.Username,
+		Discriminator: member.User.Discriminator,
+		Nick:          member.Nick,
+		JoinedAt:      string(member.JoinedAt),
+		Status:        string(discordgo.StatusOffline),
+		Roles:         []memberRole{},
+	}
+
+	for _, roleID := range member.Roles {
+		role := memberRole{ID: roleID, Slug: slugs[roleID]}
+		if dRole, err := bot.DG.State.Role(guildID, roleID); err == nil {
+			role.Name = dRole.Name
+		}
+
+		info.Roles = append(info.Roles, role)
+	}
+
+	bot.guildPresencesMutex.Lock()
+	if presence, ok := bot.guildPresences[guildID][member.User.ID]; ok {
+		info.Status = string(presence.Status)
+		if presence.Game != nil {
+			info.Game = presence.Game.Name
+		}
+	}
+	bot.guildPresencesMutex.Unlock()
+
+	return info
+}
+
+// membersLoading responds with 503 while the member list of a guild is still
+// loading. A partial list would look like members that are missing.
+func (bot *AwakenBot) membersLoading(w http.ResponseWriter, guildID string) bool {
+	if bot.members.loadedGuilds()[guildID] {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(jobRetryAfter))
+	writeError(w, http.StatusServiceUnavailable, errMembersLoading.Error())
+	return true
+}
+
+func (bot *AwakenBot) getMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if !bot.members.hasGuild(vars["guild"]) {
+		writeError(w, http.StatusNotFound, "Unknown guild")
+		return
+	}
+
+	if bot.membersLoading(w, vars["guild"]) {
+		return
+	}
+
+	member := bot.members.get(vars["guild"], vars["discordID"])
+	if member == nil {
+		writeError(w, http.StatusNotFound, "Unknown member")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, bot.newMemberInfo(vars["guild"], member))
+}
+
+func (bot *AwakenBot) getRoleMembers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	roleID, ok := bot.rolesToIDMap[vars["guild"]][vars["slug"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unknown role")
+		return
+	}
+
+	if bot.membersLoading(w, vars["guild"]) {
+		return
+	}
+
+	page, perPage, ok := pagination(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid page or perPage")
+		return
+	}
+
+	members := bot.getMembersByRole(roleID, &discordgo.Guild{ID: vars["guild"]})
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].User.ID < members[j].User.ID
+	})
+
+	infos := []*memberInfo{}
+	// Pages past the end are empty, checked first so huge pages can't overflow
+	if page-1 <= len(members)/perPage {
+		start := (page - 1) * perPage
+		for index := start; index < len(members) && index < start+perPage; index++ {
+			infos = append(infos, bot.newMemberInfo(vars["guild"], members[index]))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"page":    page,
+		"perPage": perPage,
+		"total":   len(members),
+		"members": infos,
+	})
+}
+
+// pagination reads the page and perPage query parameters
+func pagination(r *http.Request) (int, int, bool) {
+	page, perPage := 1, membersPerPage
+
+	if value := r.URL.Query().Get("page"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return 0, 0, false
+		}
+		page = parsed
+	}
+
+	if value := r.URL.Query().Get("perPage"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > membersPerPageLimit {
+			return 0, 0, false
+		}
+		perPage = parsed
+	}
+
+	return page, perPage, true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/mux"
+)
+
+func TestPagination(t *testing.T) {
+	tests := []struct {
+		query   string
+		page    int
+		perPage int
+		ok      bool
+	}{
+		{"", 1, membersPerPage, true},
+		{"page=3&perPage=10", 3, 10, true},
+		{"perPage=" + strconv.Itoa(membersPerPageLimit), 1, membersPerPageLimit, true},
+		{"perPage=" + strconv.Itoa(membersPerPageLimit+1), 0, 0, false},
+		{"page=0", 0, 0, false},
+		{"page=-1", 0, 0, false},
+		{"perPage=0", 0, 0, false},
+		{"page=abc", 0, 0, false},
+		{"page=99999999999999999999", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		page, perPage, ok := pagination(httptest.NewRequest(http.MethodGet, "/?"+test.query, nil))
+		if page != test.page || perPage != test.perPage || ok != test.ok {
+			t.Errorf("pagination(%q) = %d, %d, %v, want %d, %d, %v", test.query, page, perPage, ok, test.page, test.perPage, test.ok)
+		}
+	}
+}
+
+func TestGetRoleMembersPages(t *testing.T) {
+	bot := &AwakenBot{
+		DG:             &discordgo.Session{State: discordgo.NewState()},
+		members:        newMemberCache(),
+		rolesToIDMap:   map[string]map[string]string{"guild": {"tester": "7"}},
+		guildPresences: make(map[string]map[string]*discordgo.Presence),
+	}
+	bot.members.reset("guild")
+	bot.members.startLoad("guild")
+	for _, chunk := range testChunks("guild", 25, 10) {
+		for _, member := range chunk.Members {
+			member.Roles = []string{"7"}
+		}
+		bot.members.addChunk(chunk)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/guilds/{guild}/roles/{slug}/members", bot.getRoleMembers)
+
+	tests := []struct {
+		query   string
+		status  int
+		members int
+	}{
+		{"", http.StatusOK, 25},
+		{"page=1&perPage=10", http.StatusOK, 10},
+		{"page=3&perPage=10", http.StatusOK, 5},
+		{"page=4&perPage=10", http.StatusOK, 0},
+		{"page=" + strconv.Itoa(int(^uint(0)>>1)) + "&perPage=" + strconv.Itoa(membersPerPageLimit), http.StatusOK, 0},
+		{"page=0", http.StatusBadRequest, 0},
+	}
+
+	for _, test := range tests {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/guilds/guild/roles/tester/members?"+test.query, nil))
+		if res.Code != test.status {
+			t.Errorf("%q: status %d, want %d", test.query, res.Code, test.status)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+
+		var body struct {
+			Members []*memberInfo `json:"members"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Members) != test.members {
+			t.Errorf("%q: %d members, want %d", test.query, len(body.Members), test.members)
+		}
+	}
+}
+
+func TestGetRoleMembersWhileLoading(t *testing.T) {
+	bot := &AwakenBot{
+		members:      newMemberCache(),
+		rolesToIDMap: map[string]map[string]string{"guild": {"tester": "7"}},
+	}
+	bot.members.reset("guild")
+	bot.members.startLoad("guild")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/guilds/{guild}/roles/{slug}/members", bot.getRoleMembers)
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/guilds/guild/roles/tester/members", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d", res.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/gorilla/mux"
+)
+
+// Scopes an API key can be granted
+const (
+	scopeRefresh = "refresh"
+	scopeJobs    = "jobs"
+	scopeRead    = "read"
+	scopeAdmin   = "admin"
+)
+
+// APIKey grants access to the HTTP API
+type APIKey struct {
+	// Name is only used for the audit log
+	Name   string
+	Key    string
+	Scopes []string
+	// Guilds the key may be used for, all guilds if empty
+	Guilds []string
+}
+
+// hasScope checks if the key was granted a scope, admin implies all scopes
+func (k *APIKey) hasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope || granted == scopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsGuild checks if the key may be used for a guild
+func (k *APIKey) allowsGuild(guildID string) bool {
+	if len(k.Guilds) == 0 {
+		return true
+	}
+
+	for _, allowed := range k.Guilds {
+		if allowed == guildID {
+			return true
+		}
+	}
+
+	return false
+}
+
+type apiKeyContext struct{}
+
+// requestKey returns the API key a request was authorised with
+func requestKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContext{}).(*APIKey)
+	return key
+}
+
+// findAPIKey returns the configured key matching the request credentials
+func findAPIKey(r *http.Request) *APIKey {
+	token := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if token == "" {
+		return nil
+	}
+
+	for index := range MyConfig.APIKeys {
+		key := &MyConfig.APIKeys[index]
+		if key.Key != "" && subtle.ConstantTimeCompare([]byte(key.Key), []byte(token)) == 1 {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// authorize only lets requests with a key granting the scope through
+func (bot *AwakenBot) authorize(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		key := findAPIKey(r)
+		name := "anonymous"
+		if key != nil {
+			name = key.Name
+		}
+
+		switch {
+		case key == nil:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(recorder, http.StatusUnauthorized, "Missing or invalid API key")
+		case !key.hasScope(scope):
+			writeError(recorder, http.StatusForbidden, "API key lacks scope "+scope)
+		case mux.Vars(r)["guild"] != "" && !key.allowsGuild(mux.Vars(r)["guild"]):
+			writeError(recorder, http.StatusForbidden, "API key is not allowed for this guild")
+		default:
+			handler(recorder, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+		}
+
+		// Denials are logged as errors, the default log level would drop notes
+		if recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden {
+			log.Errorln("[api]", name, r.RemoteAddr, r.Method, r.URL.Path, recorder.status)
+		} else {
+			log.Noteln("[api]", name, r.RemoteAddr, r.Method, r.URL.Path, recorder.status)
+		}
+
+		bot.recordRequest(r.Method+" "+routeName(r, r.URL.Path), mux.Vars(r)["guild"], recorder.status, started)
+	}
+}
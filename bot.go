@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"net/http"
 	"regexp"
 	"runtime"
@@ -13,10 +15,8 @@ import (
 	"sync"
 
 	"github.com/HeroesAwaken/GoAwaken/Log"
-	"github.com/HeroesAwaken/GoAwaken/core"
 	"github.com/bwmarrin/discordgo"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/mux"
 )
 
 type AwakenBot struct {
@@ -34,112 +34,85 @@ type AwakenBot struct {
 	GetDiscordIDByID             *sql.Stmt
 	GetAllDiscordUsers           *sql.Stmt
 	RemoveRoleByID               *sql.Stmt
-	iDB                          *core.InfluxDB
+	GetLinkedDiscordIDs          *sql.Stmt
+	InsertUnlinked               *sql.Stmt
+	GetUnlinkedByGuild           *sql.Stmt
+	WarnUnlinked                 *sql.Stmt
+	DeleteUnlinked               *sql.Stmt
+	GetMainHeroByID              *sql.Stmt
+	GetMainHeroes                *sql.Stmt
+	GetNickOptOuts               *sql.Stmt
+	GetNickOptOut                *sql.Stmt
+	InsertNickOptOut             *sql.Stmt
+	DeleteNickOptOut             *sql.Stmt
+	InsertJob                    *sql.Stmt
+	UpdateJobState               *sql.Stmt
+	GetUnfinishedJobs            *sql.Stmt
+	DeleteOldJobs                *sql.Stmt
+	GetJobByID                   *sql.Stmt
+	GetJobsByState               *sql.Stmt
+	GetDueJobs                   *sql.Stmt
+	ClaimJob                     *sql.Stmt
+	RescheduleJob                *sql.Stmt
+	CancelJob                    *sql.Stmt
+	GetScheduledJobs             *sql.Stmt
+	CountPendingJobs             *sql.Stmt
+	InsertMemberJoin             *sql.Stmt
+	UpdateMemberLeave            *sql.Stmt
+	GetRetention                 *sql.Stmt
+	GetMemberEventCounts         *sql.Stmt
+	GetNewLinkCount              *sql.Stmt
+	metrics                      metricsSink
+	prometheus                   *promRegistry
+	spool                        *spoolSink
+	metricsMutex                 sync.Mutex
+	lastMetricsError             error
+	lastMetricsErrorAt           time.Time
+	rateLimitHits                int
+	usage                        map[usageKey]*usageStat
+	usageMutex                   sync.Mutex
+	memberJoins                  map[string]int
+	memberLeaves                 map[string]int
+	retentionStats               map[string][]retentionStat
+	memberEventsMutex            sync.Mutex
+	channelActivity              map[string]map[string]*channelActivity
+	channelActivityMutex         sync.Mutex
+	digests                      map[string]*digestStats
+	digestMutex                  sync.Mutex
 	batchTicker                  *time.Ticker
 	prefix                       string
 	regexUserID                  *regexp.Regexp
-	guildMetricsTickers          map[string]*time.Ticker
+	guildTickers                 map[string]*guildTicker
+	guildTickersMutex            sync.Mutex
 	rolesToIDMap                 map[string]map[string]string
-	jobsChan                     chan botJob
-	guildMembers                 map[string]map[string]*discordgo.Member
-	guildMembersTemp             map[string]map[string]*discordgo.Member
+	jobsChan                     chan *queuedJob
+	gatewayJobs                  chan botJob
+	failedJobs                   []failedJob
+	failedJobsMutex              sync.Mutex
+	jobsOnce                     sync.Once
+	jobsMutex                    sync.Mutex
+	pendingJobs                  map[string]*queuedJob
+	absorbedRefreshes            map[string]map[string]int64
+	mergedJobs                   map[string]int
+	runningJobs                  map[*queuedJob]time.Time
+	droppedJobs                  map[string]int
+	busyWorkers                  int
+	serialJobs                   *serialKeys
+	chunksChan                   chan *memberChunk
+	members                      *memberCache
 	guildPresences               map[string]map[string]*discordgo.Presence
-	guildMembersMutex            sync.Mutex
 	guildPresencesMutex          sync.Mutex
 	mapUpdateUsersVariableAmount map[int]*sql.Stmt
 }
 
-type botJob struct {
-	jobType      string
-	data         interface{}
-	discordGuild string
-}
-
-func (bot *AwakenBot) processJobs(s *discordgo.Session) {
-	go func() {
-		for {
-			select {
-			case job := <-bot.jobsChan:
-				log.Debugln(len(bot.jobsChan), "Jobs waiting to be processed")
-				guild, _ := s.State.Guild(job.discordGuild)
-
-				// Calculate online users
-				bot.guildPresencesMutex.Lock()
-				bot.guildPresences[guild.ID] = make(map[string]*discordgo.Presence)
-				for index := range guild.Presences {
-					bot.guildPresences[guild.ID][guild.Presences[index].User.ID] = guild.Presences[index]
-				}
-				bot.guildPresencesMutex.Unlock()
-				//log.Debugln("Online Members:", len(bot.guildPresences[guild.ID]))
-
-				switch job.jobType {
-				case "addMembers":
-					if members, ok := job.data.([]*discordgo.Member); ok {
-						log.Noteln("Adding" + strconv.Itoa(len(members)) + " members to roles.")
-						for index := range members {
-							memberID := members[index].User.ID
-							bot.guildMembersTemp[guild.ID][memberID] = members[index]
-						}
-
-						// Chunk lower than 1000 means it's the end
-						if len(members) < 1000 {
-							bot.guildPresencesMutex.Lock()
-							bot.guildMembers[guild.ID] = make(map[string]*discordgo.Member)
-							bot.guildMembers[guild.ID] = bot.guildMembersTemp[guild.ID]
-							bot.guildPresencesMutex.Unlock()
-						}
-					}
-					log.Noteln("Total Members:", len(bot.guildMembersTemp[guild.ID]))
-
-				case "refresh":
-					if discordID, ok := job.data.(string); ok {
-						bot.refreshUser(discordID, guild, s)
-					}
-				case "refreshNicks":
-					bot.refeshNicks(guild, s)
-				case "refreshAll":
-
-					rows, err := bot.GetAllLinkedUsers.Query()
-					defer rows.Close()
-					if err != nil {
-						log.Errorln("Error getting all users.")
-					}
-
-					count := 0
-					for rows.Next() {
-						var discordID, slugs string
-
-						err := rows.Scan(&discordID, &slugs)
-						if err != nil {
-							log.Errorln("Issue with database:", err.Error())
-						}
-
-						slugsSlice := strings.Split(slugs, ",")
-
-						for _, slug := range slugsSlice {
-							// Check if we have a matching discord role for the slug
-							if roleID, ok := bot.rolesToIDMap[guild.ID][slug]; ok {
-								log.Debugln("Assigning Role:", guild.ID, discordID, roleID)
-								s.GuildMemberRoleAdd(guild.ID, discordID, roleID)
-							}
-						}
-
-						count++
-					}
-
-					log.Noteln("Updated " + strconv.Itoa(count) + " users.")
-				}
-			}
-		}
-	}()
-}
-
 // NewAwakenBot creates a new AwakenBot that collects metrics
-func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics *core.InfluxDB, prefix string) *AwakenBot {
+func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics metricsSink, prometheus *promRegistry, spool *spoolSink, prefix string) *AwakenBot {
 	var err error
 
 	bot := new(AwakenBot)
-	bot.iDB = metrics
+	bot.metrics = metrics
+	bot.prometheus = prometheus
+	bot.spool = spool
 	bot.DB = db
 	bot.DG = dg
 	bot.prefix = prefix
@@ -147,9 +120,26 @@ func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics *core.InfluxDB, pre
 	bot.regexUserID, _ = regexp.Compile("<@([0-9]+)>")
 
 	// store max of 1000 jobs
-	bot.jobsChan = make(chan botJob, 1000)
+	bot.jobsChan = make(chan *queuedJob, 1000)
+	bot.gatewayJobs = make(chan botJob, 1000)
+	bot.pendingJobs = make(map[string]*queuedJob)
+	bot.absorbedRefreshes = make(map[string]map[string]int64)
+	bot.mergedJobs = make(map[string]int)
+	bot.runningJobs = make(map[*queuedJob]time.Time)
+	bot.droppedJobs = make(map[string]int)
+	bot.usage = make(map[usageKey]*usageStat)
+	bot.memberJoins = make(map[string]int)
+	bot.memberLeaves = make(map[string]int)
+	bot.retentionStats = make(map[string][]retentionStat)
+	bot.channelActivity = make(map[string]map[string]*channelActivity)
+	bot.digests = make(map[string]*digestStats)
+	bot.serialJobs = newSerialKeys()
+	bot.chunksChan = make(chan *memberChunk, 100)
+	bot.members = newMemberCache()
 	bot.mapUpdateUsersVariableAmount = make(map[int]*sql.Stmt)
 
+	bot.migrateSchema()
+
 	bot.GetUserRolesByDiscordID, err = bot.DB.Prepare("SELECT roles.slug" +
 		"	FROM user_discords" +
 		"	LEFT JOIN role_user" +
@@ -253,6 +243,237 @@ func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics *core.InfluxDB, pre
 		log.Fatalln("Could not prepare statement GetAllLinkedUsers.", err.Error())
 	}
 
+	bot.GetLinkedDiscordIDs, err = bot.DB.Prepare("SELECT discord_id" +
+		"	FROM user_discords")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetLinkedDiscordIDs.", err.Error())
+	}
+
+	bot.InsertUnlinked, err = bot.DB.Prepare("INSERT IGNORE INTO bot_unlinked_members" +
+		"	(guild_id, discord_id, first_seen)" +
+		"	VALUES (?, ?, ?)")
+	if err != nil {
+		log.Fatalln("Could not prepare statement InsertUnlinked.", err.Error())
+	}
+
+	bot.GetUnlinkedByGuild, err = bot.DB.Prepare("SELECT discord_id, first_seen, warned" +
+		"	FROM bot_unlinked_members" +
+		"	WHERE guild_id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetUnlinkedByGuild.", err.Error())
+	}
+
+	bot.WarnUnlinked, err = bot.DB.Prepare("INSERT INTO bot_unlinked_members" +
+		"	(guild_id, discord_id, first_seen, warned)" +
+		"	VALUES (?, ?, ?, 1)" +
+		"	ON DUPLICATE KEY UPDATE first_seen = VALUES(first_seen), warned = 1")
+	if err != nil {
+		log.Fatalln("Could not prepare statement WarnUnlinked.", err.Error())
+	}
+
+	bot.DeleteUnlinked, err = bot.DB.Prepare("DELETE FROM bot_unlinked_members" +
+		"	WHERE guild_id = ?" +
+		"		AND discord_id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement DeleteUnlinked.", err.Error())
+	}
+
+	bot.GetMainHeroByID, err = bot.DB.Prepare("SELECT heroName" +
+		"	FROM game_heroes" +
+		"	WHERE user_id = ?" +
+		"	ORDER BY id" +
+		"	LIMIT 1")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetMainHeroByID.", err.Error())
+	}
+
+	bot.GetMainHeroes, err = bot.DB.Prepare("SELECT game_heroes.user_id, game_heroes.heroName" +
+		"	FROM game_heroes" +
+		"	INNER JOIN (SELECT user_id, MIN(id) AS id" +
+		"		FROM game_heroes" +
+		"		GROUP BY user_id) AS main_heroes" +
+		"		ON game_heroes.id = main_heroes.id")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetMainHeroes.", err.Error())
+	}
+
+	bot.GetNickOptOuts, err = bot.DB.Prepare("SELECT discord_id" +
+		"	FROM bot_nick_optout")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetNickOptOuts.", err.Error())
+	}
+
+	bot.GetNickOptOut, err = bot.DB.Prepare("SELECT COUNT(*)" +
+		"	FROM bot_nick_optout" +
+		"	WHERE discord_id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetNickOptOut.", err.Error())
+	}
+
+	bot.InsertNickOptOut, err = bot.DB.Prepare("INSERT IGNORE INTO bot_nick_optout" +
+		"	(discord_id)" +
+		"	VALUES (?)")
+	if err != nil {
+		log.Fatalln("Could not prepare statement InsertNickOptOut.", err.Error())
+	}
+
+	bot.DeleteNickOptOut, err = bot.DB.Prepare("DELETE FROM bot_nick_optout" +
+		"	WHERE discord_id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement DeleteNickOptOut.", err.Error())
+	}
+
+	bot.InsertJob, err = bot.DB.Prepare("INSERT INTO bot_jobs" +
+		"	(job_type, guild_id, payload, state, created_at, run_at)" +
+		"	VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalln("Could not prepare statement InsertJob.", err.Error())
+	}
+
+	bot.UpdateJobState, err = bot.DB.Prepare("UPDATE bot_jobs" +
+		"	SET state = ?, attempts = ?, last_error = ?," +
+		"		started_at = COALESCE(?, started_at)," +
+		"		finished_at = COALESCE(?, finished_at)" +
+		"	WHERE id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement UpdateJobState.", err.Error())
+	}
+
+	bot.GetUnfinishedJobs, err = bot.DB.Prepare("SELECT id, job_type, guild_id, payload, attempts, created_at" +
+		"	FROM bot_jobs" +
+		"	WHERE state IN ('queued', 'running')" +
+		"	ORDER BY id")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetUnfinishedJobs.", err.Error())
+	}
+
+	bot.DeleteOldJobs, err = bot.DB.Prepare("DELETE FROM bot_jobs" +
+		"	WHERE state IN ('succeeded', 'failed', 'cancelled')" +
+		"		AND finished_at < ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement DeleteOldJobs.", err.Error())
+	}
+
+	bot.GetJobByID, err = bot.DB.Prepare("SELECT id, job_type, guild_id, payload, state, attempts, last_error, created_at, started_at, finished_at, run_at" +
+		"	FROM bot_jobs" +
+		"	WHERE id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetJobByID.", err.Error())
+	}
+
+	bot.GetJobsByState, err = bot.DB.Prepare("SELECT id, job_type, guild_id, payload, state, attempts, last_error, created_at, started_at, finished_at, run_at" +
+		"	FROM bot_jobs" +
+		"	WHERE state = ? OR ? = ''" +
+		"	ORDER BY id DESC" +
+		"	LIMIT ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetJobsByState.", err.Error())
+	}
+
+	bot.GetDueJobs, err = bot.DB.Prepare("SELECT id, job_type, guild_id, payload, state, attempts, created_at" +
+		"	FROM bot_jobs" +
+		"	WHERE state IN (?, ?)" +
+		"		AND run_at <= ?" +
+		"	ORDER BY run_at")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetDueJobs.", err.Error())
+	}
+
+	bot.ClaimJob, err = bot.DB.Prepare("UPDATE bot_jobs" +
+		"	SET state = ?" +
+		"	WHERE id = ?" +
+		"		AND state = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement ClaimJob.", err.Error())
+	}
+
+	bot.RescheduleJob, err = bot.DB.Prepare("UPDATE bot_jobs" +
+		"	SET state = ?, attempts = ?, last_error = ?, run_at = ?" +
+		"	WHERE id = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement RescheduleJob.", err.Error())
+	}
+
+	bot.CancelJob, err = bot.DB.Prepare("UPDATE bot_jobs" +
+		"	SET state = ?, finished_at = ?" +
+		"	WHERE id = ?" +
+		"		AND state = ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement CancelJob.", err.Error())
+	}
+
+	bot.GetScheduledJobs, err = bot.DB.Prepare("SELECT id, job_type, guild_id, payload, run_at" +
+		"	FROM bot_jobs" +
+		"	WHERE state = ?" +
+		"	ORDER BY run_at" +
+		"	LIMIT ?")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetScheduledJobs.", err.Error())
+	}
+
+	bot.CountPendingJobs, err = bot.DB.Prepare("SELECT COUNT(*)" +
+		"	FROM bot_jobs" +
+		"	WHERE job_type = ?" +
+		"		AND guild_id = ?" +
+		"		AND payload = ?" +
+		"		AND state IN ('scheduled', 'queued', 'retrying')")
+	if err != nil {
+		log.Fatalln("Could not prepare statement CountPendingJobs.", err.Error())
+	}
+
+	bot.InsertMemberJoin, err = bot.DB.Prepare("INSERT INTO bot_member_events" +
+		"	(guild_id, discord_id, joined_at)" +
+		"	VALUES (?, ?, ?)")
+	if err != nil {
+		log.Fatalln("Could not prepare statement InsertMemberJoin.", err.Error())
+	}
+
+	bot.UpdateMemberLeave, err = bot.DB.Prepare("UPDATE bot_member_events" +
+		"	SET left_at = ?, linked = EXISTS (SELECT 1 FROM user_discords WHERE discord_id = ?)" +
+		"	WHERE guild_id = ? AND discord_id = ? AND left_at IS NULL")
+	if err != nil {
+		log.Fatalln("Could not prepare statement UpdateMemberLeave.", err.Error())
+	}
+
+	// Members that left count as linked if they were linked when leaving,
+	// everybody else if they're linked right now
+	bot.GetRetention, err = bot.DB.Prepare("SELECT COALESCE(bot_member_events.linked, user_discords.discord_id IS NOT NULL) AS is_linked," +
+		"		COUNT(*)," +
+		"		SUM(bot_member_events.left_at IS NULL OR bot_member_events.left_at >= bot_member_events.joined_at + ?)" +
+		"	FROM bot_member_events" +
+		"	LEFT JOIN user_discords" +
+		"		ON user_discords.discord_id = bot_member_events.discord_id" +
+		"	WHERE bot_member_events.guild_id = ?" +
+		"		AND bot_member_events.joined_at >= ?" +
+		"		AND bot_member_events.joined_at < ?" +
+		"	GROUP BY is_linked")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetRetention.", err.Error())
+	}
+
+	bot.GetMemberEventCounts, err = bot.DB.Prepare("SELECT" +
+		"	(SELECT COUNT(*) FROM bot_member_events WHERE guild_id = ? AND joined_at >= ?)," +
+		"	(SELECT COUNT(*) FROM bot_member_events WHERE guild_id = ? AND left_at >= ?)")
+	if err != nil {
+		log.Fatalln("Could not prepare statement GetMemberEventCounts.", err.Error())
+	}
+
+	bot.GetNewLinkCount, err = bot.DB.Prepare("SELECT COUNT(*)" +
+		"	FROM user_discords" +
+		"	WHERE created_at >= FROM_UNIXTIME(?)")
+	if err != nil {
+		// Older schemas don't know when a discord was linked, the digest
+		// goes without it
+		log.Errorln("Could not prepare statement GetNewLinkCount.", err.Error())
+		bot.GetNewLinkCount = nil
+	}
+
+	// Before anything else can queue new jobs
+	bot.resumeJobs()
+	bot.processGatewayJobs()
+	bot.processChunks(bot.DG)
+	bot.processScheduledJobs()
+
 	bot.CollectGlobalMetrics()
 	bot.batchTicker = time.NewTicker(time.Second * 10)
 	go func() {
@@ -263,10 +484,8 @@ func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics *core.InfluxDB, pre
 
 	//Populate rolesToIdMap
 	bot.rolesToIDMap = make(map[string]map[string]string)
-	bot.guildMembers = make(map[string]map[string]*discordgo.Member)
-	bot.guildMembersTemp = make(map[string]map[string]*discordgo.Member)
 	bot.guildPresences = make(map[string]map[string]*discordgo.Presence)
-	bot.guildMetricsTickers = make(map[string]*time.Ticker)
+	bot.guildTickers = make(map[string]*guildTicker)
 
 	// MakaTesting
 	bot.rolesToIDMap["320696414483120129"] = make(map[string]string)
@@ -283,9 +502,7 @@ func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics *core.InfluxDB, pre
 	bot.rolesToIDMap["329078443687936001"]["communitymanager"] = "330085415182663682"
 	bot.rolesToIDMap["329078443687936001"]["tester"] = "340576558249148430"
 
-	r := mux.NewRouter()
-	r.HandleFunc("/api/refresh/{guild}/{id}", bot.refresh)
-	r.HandleFunc("/api/refreshNicks/{guild}", bot.refreshNicks)
+	r := bot.newRouter()
 
 	go func() {
 		log.Noteln(http.ListenAndServe("0.0.0.0:4000", r))
@@ -304,40 +521,11 @@ func NewAwakenBot(db *sql.DB, dg *discordgo.Session, metrics *core.InfluxDB, pre
 	bot.DG.AddHandler(bot.guildMembersChunk)
 	bot.DG.AddHandler(bot.memberRemove)
 	bot.DG.AddHandler(bot.memberUpdate)
+	bot.DG.AddHandler(bot.rateLimit)
 
 	return bot
 }
 
-func (bot *AwakenBot) refreshNicks(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	log.Debugln("HTTP request refresh", vars["guild"])
-
-	bot.jobsChan <- botJob{
-		jobType:      "refreshNicks",
-		discordGuild: vars["guild"],
-	}
-}
-
-func (bot *AwakenBot) refresh(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	log.Debugln("HTTP request refresh", vars["id"])
-	log.Debugln("HTTP request refresh", vars["guild"])
-
-	if vars["id"] == "all" {
-		bot.jobsChan <- botJob{
-			jobType:      "refreshAll",
-			discordGuild: vars["guild"],
-		}
-		return
-	}
-
-	bot.jobsChan <- botJob{
-		jobType:      "refresh",
-		data:         vars["id"],
-		discordGuild: vars["guild"],
-	}
-}
-
 func (bot *AwakenBot) updateUsersByDiscordId(usersAmount int) *sql.Stmt {
 	var err error
 
@@ -369,6 +557,22 @@ func (bot *AwakenBot) updateUsersByDiscordId(usersAmount int) *sql.Stmt {
 
 }
 
+// addMetric sends a metric to the configured sinks and remembers if that failed
+func (bot *AwakenBot) addMetric(name string, tags map[string]string, fields map[string]interface{}) {
+	err := bot.metrics.AddMetric(name, tags, fields)
+
+	bot.metricsMutex.Lock()
+	bot.lastMetricsError = err
+	if err != nil {
+		bot.lastMetricsErrorAt = time.Now()
+	}
+	bot.metricsMutex.Unlock()
+
+	if err != nil {
+		log.Errorln("Error adding Metric:", err)
+	}
+}
+
 // CollectGlobalMetrics collects global metrics about the bot and environment
 // And sends them to influxdb
 func (bot *AwakenBot) CollectGlobalMetrics() {
@@ -381,10 +585,55 @@ func (bot *AwakenBot) CollectGlobalMetrics() {
 		"memHeapSys":    int(mem.HeapSys),
 	}
 
-	err := bot.iDB.AddMetric("server_metrics", tags, fields)
-	if err != nil {
-		log.Errorln("Error adding Metric:", err)
+	bot.addMetric("server_metrics", tags, fields)
+
+	bot.jobsMutex.Lock()
+	merged := make(map[string]int)
+	for jobType, count := range bot.mergedJobs {
+		merged[jobType] = count
 	}
+	bot.jobsMutex.Unlock()
+
+	for jobType, count := range merged {
+		tags := map[string]string{"metric": "job_merges", "server": "global", "jobType": jobType}
+		fields := map[string]interface{}{
+			"merged": count,
+		}
+
+		bot.addMetric("job_metrics", tags, fields)
+	}
+
+	bot.jobsMutex.Lock()
+	busy := bot.busyWorkers
+	bot.jobsMutex.Unlock()
+
+	tags = map[string]string{"metric": "job_workers", "server": "global"}
+	fields = map[string]interface{}{
+		"busyWorkers":  busy,
+		"totalWorkers": MyConfig.JobWorkers,
+		"utilisation":  float64(busy) / float64(MyConfig.JobWorkers),
+	}
+
+	bot.addMetric("job_metrics", tags, fields)
+
+	bot.jobsMutex.Lock()
+	dropped := make(map[string]int)
+	for jobType, count := range bot.droppedJobs {
+		dropped[jobType] = count
+	}
+	bot.jobsMutex.Unlock()
+
+	for jobType, count := range dropped {
+		tags := map[string]string{"metric": "job_drops", "server": "global", "jobType": jobType}
+		fields := map[string]interface{}{
+			"dropped": count,
+		}
+
+		bot.addMetric("job_metrics", tags, fields)
+	}
+
+	bot.collectUsageMetrics()
+	bot.collectRuntimeMetrics()
 }
 
 // This function will be called (due to AddHandler above) when the bot receives
@@ -412,12 +661,13 @@ func (bot *AwakenBot) memberAdd(s *discordgo.Session, event *discordgo.GuildMemb
 	member, err := s.State.Member(g.ID, event.User.ID)
 	if err != nil {
 		log.Errorln("Could not turn joining user to member")
+		member = event.Member
 	}
 
-	bot.guildMembersMutex.Lock()
-	bot.guildMembers[g.ID][event.User.ID] = member
-	bot.guildMembersMutex.Unlock()
-	bot.refreshUser(event.User.ID, g, s)
+	bot.members.set(g.ID, member)
+
+	// Don't block the gateway while talking to discord and the database
+	bot.enqueueAsync(memberJoinJob{guildID: g.ID, discordID: event.User.ID, at: time.Now()})
 }
 
 func (bot *AwakenBot) memberUpdate(s *discordgo.Session, event *discordgo.GuildMemberUpdate) {
@@ -427,12 +677,10 @@ func (bot *AwakenBot) memberUpdate(s *discordgo.Session, event *discordgo.GuildM
 	roleExisted := make(map[string]bool)
 	oldroles := []string{}
 
-	bot.guildMembersMutex.Lock()
-	if bot.guildMembers[event.GuildID][event.User.ID] != nil {
-		oldroles = bot.guildMembers[event.GuildID][event.User.ID].Roles
+	if old := bot.members.get(event.GuildID, event.User.ID); old != nil {
+		oldroles = old.Roles
 	}
-	bot.guildMembers[event.GuildID][event.User.ID] = event.Member
-	bot.guildMembersMutex.Unlock()
+	bot.members.set(event.GuildID, event.Member)
 
 	for _, oldRole := range oldroles {
 		roleExisted[oldRole] = true
@@ -446,6 +694,8 @@ func (bot *AwakenBot) memberUpdate(s *discordgo.Session, event *discordgo.GuildM
 	}
 
 	if isNewTester {
+		bot.recordNewTester(event.GuildID)
+
 		var id, title, slug string
 		err := bot.GetRoleBySlug.QueryRow("tester").Scan(&id, &title, &slug)
 		if err != nil {
@@ -485,9 +735,9 @@ func (bot *AwakenBot) memberRemove(s *discordgo.Session, event *discordgo.GuildM
 		return
 	}
 
-	bot.guildMembersMutex.Lock()
-	delete(bot.guildMembers[g.ID], event.User.ID)
-	bot.guildMembersMutex.Unlock()
+	bot.members.remove(g.ID, event.User.ID)
+
+	bot.enqueueAsync(memberLeaveJob{guildID: g.ID, discordID: event.User.ID, at: time.Now()})
 }
 
 // This function will be called (due to AddHandler above) every time a new
@@ -514,6 +764,10 @@ func (bot *AwakenBot) messageCreate(s *discordgo.Session, m *discordgo.MessageCr
 		return
 	}
 
+	if !m.Author.Bot {
+		bot.recordMessage(g.ID, c.ID, m.Author.ID)
+	}
+
 	// check if the message starts with our prefix
 	if strings.HasPrefix(m.Content, "!ha ") {
 
@@ -544,13 +798,18 @@ func (bot *AwakenBot) messageCreate(s *discordgo.Session, m *discordgo.MessageCr
 			log.Errorln("Error seting Reaction:", err.Error())
 		}
 
+		started := time.Now()
+		outcome := outcomeSuccess
+
 		switch command {
 		case "help":
 			embed := NewEmbed().
 				SetTitle("HeroesAwaken").
 				SetDescription("Your friendly bot :)").
 				AddField(bot.prefix+" help", "Show this lovely help").
-				AddField(bot.prefix+" refresh", "Manually refresh your roles").
+				AddField(bot.prefix+" refresh ["+allGuildsFlag+"]", "Manually refresh your roles").
+				AddField(bot.prefix+" refresh USER ["+allGuildsFlag+"]", "Refreshes the roles of the user specified\n*Available for CommunityManager+*").
+				AddField(bot.prefix+" nick keep|sync", "Keep your own nickname or sync it with the homepage again").
 				AddField(bot.prefix+" check discord:DISCORDID", "Checks a discord user by his discord ID\n*Available for CommunityManager+*").
 				AddField(bot.prefix+" check hero:HERONAME", "Checks a hero and shows his discord ID etc\n*Available for CommunityManager+*").
 				AddField(bot.prefix+" check website:WEBSITEUSERNAME", "Checks a user by his website Name\n*Available for CommunityManager+*").
@@ -559,55 +818,67 @@ func (bot *AwakenBot) messageCreate(s *discordgo.Session, m *discordgo.MessageCr
 				AddField(bot.prefix+" removePlayer hero:HERONAME", "Removes the Player role from the Hero specified\n*Available for CommunityManager+*").
 				AddField(bot.prefix+" removePlayer website:WEBSITEUSERNAME", "Removes the Player role from the Website username specified\n*Available for CommunityManager+*").
 				AddField(bot.prefix+" removePlayer @USER", "Removes the Player role from the User tagged\n*Available for CommunityManager+*").
+				AddField(bot.prefix+" removePlayer USER "+allGuildsFlag, "Removes the Player role on every guild\n*Available for CommunityManager+*").
+				AddField(bot.prefix+" syncRole ROLENAME ["+allGuildsFlag+"]", "Assigns a discord role to its members on the homepage\n*Available for AwokenLead*").
 				AddField(bot.prefix+" stats discord:DISCORDID", "Check stats of the ID specified").
 				AddField(bot.prefix+" stats hero:HERONAME", "Check stats of the Hero specified").
 				AddField(bot.prefix+" stats website:WEBSITEUSERNAME", "Check stats of the Website username specified").
 				AddField(bot.prefix+" stats @USER", "Check stats of the User tagged").
 				AddField(bot.prefix+" stats ", "Check your stats").
+				AddField(bot.prefix+" jobs", "Shows queued, running and failed jobs\n*Available for Staff+*").
+				AddField(bot.prefix+" jobs scheduled", "Shows the next scheduled jobs\n*Available for Staff+*").
+				AddField(bot.prefix+" jobs cancel ID", "Cancels a scheduled job\n*Available for Staff+*").
+				AddField(bot.prefix+" tempRole USER ROLENAME DAYS", "Assigns a role that is removed again after some days\n*Available for CommunityManager+*").
+				AddField(bot.prefix+" retention", "Shows how many new members stay\n*Available for Staff+*").
 				SetThumbnail("https://heroesawaken.com/images/logo_new_small.png").
 				//SetColor(0x00ff00).
 				MessageEmbed
-			s.ChannelMessageSendEmbed(m.ChannelID, embed)
-
-		case "refresh":
-			err = bot.DB.Ping()
+			_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed)
 			if err != nil {
-				log.Errorln("Error with database: ", err.Error())
-				return
-			}
-
-			if len(args) == 0 {
-				bot.refreshUserChannel(m.Author.ID, c, g, s)
-				return
+				log.Errorln(err)
+				outcome = outcomeInternal
 			}
 
+		case "refresh":
+			outcome = bot.cmdRefresh(s, c, g, m, args)
+		case "tempRole":
+			outcome = bot.cmdTempRole(s, c, g, m, args)
+		case "jobs":
+			outcome = bot.cmdJobs(s, c, g, m, args)
+		case "nick":
+			outcome = bot.cmdNick(s, c, g, m, args)
 		case "syncRole":
-			bot.cmdSync(s, c, g, m, args)
+			outcome = bot.cmdSync(s, c, g, m, args)
 		case "stats":
-			bot.cmdStats(s, c, g, m, args)
+			outcome = bot.cmdStats(s, c, g, m, args)
 		case "check":
-			bot.cmdCheck(s, c, g, m, args)
+			outcome = bot.cmdCheck(s, c, g, m, args)
 		case "removePlayer":
-			bot.cmdRemovePlayer(s, c, g, m, args)
+			outcome = bot.cmdRemovePlayer(s, c, g, m, args)
+		case "retention":
+			outcome = bot.cmdRetention(s, c, g, m, args)
 		default:
 			bot.send(m.Author.ID, "Unknown function :shrug:", c, g, s)
+			// Don't create a series for every typo
+			command = "unknown"
+			outcome = outcomeUsage
 		}
+
+		bot.recordCommand(command, g.Name, outcome, started)
 	}
 }
 
 func (bot *AwakenBot) getMembersByRole(roleID string, g *discordgo.Guild) []*discordgo.Member {
 	var members []*discordgo.Member
 
-	bot.guildMembersMutex.Lock()
-	for index := range bot.guildMembers[g.ID] {
-		for _, role := range bot.guildMembers[g.ID][index].Roles {
+	bot.members.each(g.ID, func(discordID string, member *discordgo.Member) {
+		for _, role := range member.Roles {
 			if role == roleID {
-				members = append(members, bot.guildMembers[g.ID][index])
+				members = append(members, member)
 				break
 			}
 		}
-	}
-	bot.guildMembersMutex.Unlock()
+	})
 
 	return members
 }
@@ -634,31 +905,47 @@ func (bot *AwakenBot) send(discordID string, message string, channel *discordgo.
 	}
 }
 
-func (bot *AwakenBot) refeshNicks(guild *discordgo.Guild, s *discordgo.Session) {
-	rows, err := bot.GetAllDiscordUsers.Query()
-	defer rows.Close()
+func (bot *AwakenBot) refeshNicks(ctx context.Context, guild *discordgo.Guild, s *discordgo.Session) error {
+	rows, err := bot.GetAllDiscordUsers.QueryContext(ctx)
 	if err != nil {
 		log.Errorln("Unable to get all Discord Users", err.Error())
+		return err
 	}
+	defer rows.Close()
 
-	users := make(map[string]string)
+	users := make(map[string][2]string)
 
 	for rows.Next() {
 		var userID, username, email, birthday, ipAddress, discordName, discordEmail, discordDiscriminator, discordID sql.NullString
 		err := rows.Scan(&userID, &username, &email, &birthday, &ipAddress, &discordName, &discordEmail, &discordDiscriminator, &discordID)
 		if err != nil {
 			log.Errorln("Issue with database:", err.Error())
+			continue
 		}
 
-		users[discordID.String] = username.String
+		users[discordID.String] = [2]string{userID.String, username.String}
+	}
+
+	optOuts, err := bot.nickOptOuts(ctx)
+	if err != nil {
+		return err
+	}
+
+	heroes, err := bot.mainHeroes(ctx)
+	if err != nil {
+		return err
 	}
 
+	report := nickReport{}
+
 	i := 0
 	for discordID, user := range users {
-		err = s.GuildMemberNickname(guild.ID, discordID, user)
-		if err != nil {
-			log.Errorln("Unable to set member nickname to "+user, err.Error())
+		if ctx.Err() != nil {
+			return errPermanent{ctx.Err()}
 		}
+
+		err := bot.syncNick(guild, discordID, user[0], user[1], heroes, optOuts, &report, s)
+		bot.retryNick(guild, discordID, err)
 		i++
 
 		if i%10 == 0 {
@@ -666,104 +953,152 @@ func (bot *AwakenBot) refeshNicks(guild *discordgo.Guild, s *discordgo.Session)
 		}
 	}
 
-	log.Debugln("All nicknames updated.")
+	log.Noteln("Nicknames on " + guild.Name + " synced: " + report.String())
+	return nil
 }
 
-func (bot *AwakenBot) refreshUser(discordID string, guild *discordgo.Guild, s *discordgo.Session) {
-	bot.refreshUserChannel(discordID, nil, guild, s)
+func (bot *AwakenBot) refreshUser(ctx context.Context, discordID string, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.refreshUserChannel(ctx, discordID, nil, []*discordgo.Guild{guild}, true, s)
 }
 
-func (bot *AwakenBot) refreshUserChannel(discordID string, channel *discordgo.Channel, guild *discordgo.Guild, s *discordgo.Session) {
+// refreshUserChannel refreshes a user on all given guilds and sends one message
+// with the results. If the caller retries, the message waits for the last try.
+func (bot *AwakenBot) refreshUserChannel(ctx context.Context, discordID string, channel *discordgo.Channel, guilds []*discordgo.Guild, retried bool, s *discordgo.Session) error {
 	log.Debugln("Refreshing discordID", discordID)
 
-	privateChannel, err := s.UserChannelCreate(discordID)
+	var lastErr error
+	var notLinked *discordgo.Guild
+	synced := []string{}
+	for _, guild := range guilds {
+		if ctx.Err() != nil {
+			return errPermanent{ctx.Err()}
+		}
 
-	if err != nil {
-		if channel != nil {
-			privateChannel = channel
-		} else {
-			log.Error("Can't create private channel and no channel given")
-			// can't create private channel and no channel given
-			return
+		count, err := bot.refreshMember(ctx, discordID, guild, s)
+		if err == errNotLinked {
+			// Keep going, every guild has to mark the member as unlinked
+			notLinked = guild
+			continue
 		}
+		if err != nil {
+			log.Errorln("Could not refresh "+discordID+" on "+guild.Name, err.Error())
+			lastErr = err
+			continue
+		}
+
+		synced = append(synced, guild.Name+" ("+strconv.Itoa(count)+" roles)")
 	}
 
-	userID, err := bot.getUserID("discord:"+discordID, s, guild)
-	if err != nil {
-		_, err := s.ChannelMessageSend(privateChannel.ID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)")
-		if err != nil && channel != nil {
-			_, err = s.ChannelMessageSend(channel.ID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)")
-			if err != nil {
-				log.Errorln(err)
-			}
-		}
-		return
+	// The retry sends the messages, otherwise the user gets them every time
+	if retried && lastErr != nil && isRetryable(lastErr) {
+		return lastErr
 	}
 
-	rows, err := bot.GetUserRolesByDiscordID.Query(discordID)
-	defer rows.Close()
+	if notLinked != nil && len(synced) == 0 {
+		bot.send(discordID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)", channel, notLinked, s)
+	}
+
+	if len(synced) > 0 {
+		bot.send(discordID, "We successfully synced your roles on "+strings.Join(synced, ", ")+"!", channel, nil, s)
+	}
+
+	return lastErr
+}
+
+var errNotLinked = errors.New("Discord account is not linked")
+
+// memberSlugs returns the website roles of a linked user
+func (bot *AwakenBot) memberSlugs(ctx context.Context, discordID string) ([]string, error) {
+	rows, err := bot.GetUserRolesByDiscordID.QueryContext(ctx, discordID)
 	if err != nil {
-		_, err := s.ChannelMessageSend(privateChannel.ID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)")
-		if err != nil && channel != nil {
-			_, err = s.ChannelMessageSend(channel.ID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)")
-			if err != nil {
-				log.Errorln(err)
-			}
-		}
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
-	count := 0
+	var slugs []string
 	for rows.Next() {
 		var slug string
 
 		err := rows.Scan(&slug)
 		if err != nil {
 			log.Errorln("Issue with database:", err.Error())
+			continue
 		}
 
+		slugs = append(slugs, slug)
+	}
+
+	return slugs, rows.Err()
+}
+
+// addMemberRoles assigns the discord roles of the given website roles,
+// the last failure is returned
+func (bot *AwakenBot) addMemberRoles(guild *discordgo.Guild, discordID string, slugs []string, s *discordgo.Session) error {
+	var lastErr error
+	for _, slug := range slugs {
 		// Check if we have a matching discord role for the slug
 		if roleID, ok := bot.rolesToIDMap[guild.ID][slug]; ok {
 			log.Debugln("Assigning Role:", guild.ID, discordID, roleID)
-			err = s.GuildMemberRoleAdd(guild.ID, discordID, roleID)
+			err := s.GuildMemberRoleAdd(guild.ID, discordID, roleID)
 			if err != nil {
 				log.Errorln(err)
+				lastErr = err
 			}
 		}
+	}
 
-		count++
+	return lastErr
+}
+
+// refreshMember assigns all website roles and the nickname of a user on a guild
+func (bot *AwakenBot) refreshMember(ctx context.Context, discordID string, guild *discordgo.Guild, s *discordgo.Session) (int, error) {
+	var userID string
+	err := bot.GetIDByDiscordID.QueryRowContext(ctx, discordID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		// Reconciliation strips the managed roles once the grace period passed
+		bot.markUnlinked(guild.ID, discordID)
+		return 0, errNotLinked
+	}
+	if err != nil {
+		// Database trouble, the job is retried
+		return 0, err
+	}
+
+	slugs, err := bot.memberSlugs(ctx, discordID)
+	if err != nil {
+		return 0, err
 	}
 
+	count := len(slugs)
+	roleErr := bot.addMemberRoles(guild, discordID, slugs, s)
+
 	var id, username, email, birthday, ipAddress, discordName, discordEmail, discordDiscriminator, sqlDiscordID sql.NullString
-	err = bot.GetUserWithDiscord.QueryRow(userID).Scan(&id, &username, &email, &birthday, &ipAddress, &discordName, &discordEmail, &discordDiscriminator, &sqlDiscordID)
+	err = bot.GetUserWithDiscord.QueryRowContext(ctx, userID).Scan(&id, &username, &email, &birthday, &ipAddress, &discordName, &discordEmail, &discordDiscriminator, &sqlDiscordID)
 	if err != nil {
 		log.Errorln("Error getting user info for " + userID)
-		return
+		return count, err
 	}
 
-	err = s.GuildMemberNickname(guild.ID, discordID, username.String)
+	report := nickReport{}
+	optOuts, err := bot.nickOptOut(ctx, discordID)
 	if err != nil {
-		log.Errorln("Unable to set member nickname to "+username.String, err.Error())
+		return count, err
 	}
 
-	if count == 0 {
-		_, err := s.ChannelMessageSend(privateChannel.ID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)")
-		if err != nil && channel != nil {
-			_, err = s.ChannelMessageSend(channel.ID, "You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account! :)")
-			if err != nil {
-				log.Errorln(err)
-			}
-		}
-		return
+	heroes, err := bot.mainHero(ctx, userID)
+	if err != nil {
+		return count, err
 	}
 
-	_, err = s.ChannelMessageSend(privateChannel.ID, "We successfully synced your roles!")
-	if err != nil && channel != nil {
-		_, err = s.ChannelMessageSend(channel.ID, "We successfully synced your roles!")
-		if err != nil {
-			log.Errorln(err)
-		}
+	err = bot.syncNick(guild, discordID, userID, username.String, heroes, optOuts, &report, s)
+	bot.retryNick(guild, discordID, err)
+	log.Debugln("Nickname of", discordID, "synced:", report.String())
+
+	if count == 0 {
+		return 0, errNotLinked
 	}
+
+	return count, roleErr
 }
 
 // This function will be called (due to AddHandler above) every time a new
@@ -782,34 +1117,102 @@ func (bot *AwakenBot) guildCreate(s *discordgo.Session, event *discordgo.GuildCr
 		return
 	}
 
-	bot.guildMembersMutex.Lock()
-	bot.guildMembers[g.ID] = make(map[string]*discordgo.Member)
-	bot.guildMembersMutex.Unlock()
-	bot.guildMembersTemp[g.ID] = make(map[string]*discordgo.Member)
-
+	bot.members.reset(g.ID)
 	bot.getAllMembers(s, g)
 
 	// Collect metrics every 10 seconds
-	bot.guildMetricsTickers[g.ID] = time.NewTicker(time.Second * 10)
+	bot.startGuildTicker(g.ID, time.Second*10, func() {
+		bot.metricGuild(s, g)
+	})
+
+	// Members are kept up to date by events, a full reload only corrects drift
+	if MyConfig.MemberResyncMinutes > 0 {
+		bot.startGuildTicker("refresh:"+g.ID, time.Minute*time.Duration(MyConfig.MemberResyncMinutes), func() {
+			bot.getAllMembers(s, g)
+		})
+	}
+
+	// Strip roles of unlinked members
+	bot.startGuildTicker("reconcile:"+g.ID, time.Minute*time.Duration(MyConfig.ReconcileMinutes), func() {
+		bot.enqueueAsync(reconcileJob{guildID: g.ID})
+	})
+
+	// Calculate how many new members stay
+	bot.enqueueAsync(retentionJob{guildID: g.ID})
+	bot.startGuildTicker("retention:"+g.ID, retentionInterval, func() {
+		bot.enqueueAsync(retentionJob{guildID: g.ID})
+	})
+
+	// The digest is stored as a job, don't wait for the database here
+	go bot.scheduleDigest(g.ID, s)
+}
+
+// guildTicker runs a periodic task of a guild until it's stopped
+type guildTicker struct {
+	ticker *time.Ticker
+	done   chan bool
+}
+
+func (t *guildTicker) stop() {
+	t.ticker.Stop()
+	close(t.done)
+}
+
+// startGuildTicker runs fn every interval. A ticker started before with the
+// same key is stopped, guilds are created again after reconnects.
+func (bot *AwakenBot) startGuildTicker(key string, interval time.Duration, fn func()) {
+	t := &guildTicker{
+		ticker: time.NewTicker(interval),
+		done:   make(chan bool),
+	}
+
+	bot.guildTickersMutex.Lock()
+	if old, ok := bot.guildTickers[key]; ok {
+		old.stop()
+	}
+	bot.guildTickers[key] = t
+	bot.guildTickersMutex.Unlock()
+
 	go func() {
-		for range bot.guildMetricsTickers[g.ID].C {
-			bot.metricGuild(s, g)
+		for {
+			select {
+			case <-t.ticker.C:
+				fn()
+			case <-t.done:
+				return
+			}
 		}
 	}()
+}
 
-	// Refresh all members every 5 minutes
-	bot.guildMetricsTickers["refresh:"+g.ID] = time.NewTicker(time.Second * 300)
-	go func() {
-		for range bot.guildMetricsTickers["refresh:"+g.ID].C {
-			bot.guildMembersTemp[g.ID] = make(map[string]*discordgo.Member)
-			bot.getAllMembers(s, g)
+// Game tag of all games that are not on the allow-list
+const otherGame = "other"
+
+// gameTag returns the name a game is tracked as. Games that aren't on the
+// allow-list are grouped, otherwise every game creates its own series.
+func gameTag(name string) string {
+	if MyConfig.OwnGame != "" && strings.EqualFold(name, MyConfig.OwnGame) {
+		return MyConfig.OwnGame
+	}
+
+	for _, allowed := range MyConfig.GameAllowList {
+		if strings.EqualFold(name, allowed) {
+			return allowed
 		}
-	}()
+	}
 
+	return otherGame
 }
 
 // Create metrics about a guild
 func (bot *AwakenBot) metricGuild(s *discordgo.Session, g *discordgo.Guild) {
+	// Presence updates only reach the state, our copy would otherwise be as
+	// old as the last job or member resync
+	if guild, err := s.State.Guild(g.ID); err == nil {
+		s.State.RLock()
+		bot.updatePresences(guild)
+		s.State.RUnlock()
+	}
 
 	roles := make(map[string]int)
 	rolesStruct := make(map[string]*discordgo.Role)
@@ -819,80 +1222,75 @@ func (bot *AwakenBot) metricGuild(s *discordgo.Session, g *discordgo.Guild) {
 	online["status"] = make(map[string]int)
 	online["game"] = make(map[string]int)
 
-	bot.guildMembersMutex.Lock()
-	for index := range bot.guildMembers[g.ID] {
-		for _, role := range bot.guildMembers[g.ID][index].Roles {
-			_, ok := rolesStruct[role]
+	var memberRoles []string
+	bot.members.each(g.ID, func(discordID string, member *discordgo.Member) {
+		memberRoles = append(memberRoles, member.Roles...)
+	})
 
-			if !ok {
-				dRole, err := s.State.Role(g.ID, role)
-				if err != nil {
-					log.Errorln("Could not get discord role")
-					return
-				}
+	for _, role := range memberRoles {
+		_, ok := rolesStruct[role]
 
-				rolesStruct[role] = dRole
+		if !ok {
+			dRole, err := s.State.Role(g.ID, role)
+			if err != nil {
+				log.Errorln("Could not get discord role", role, err.Error())
+				continue
 			}
 
-			roles[rolesStruct[role].Name]++
+			rolesStruct[role] = dRole
 		}
+
+		roles[rolesStruct[role].Name]++
 	}
-	bot.guildMembersMutex.Unlock()
 
+	var onlineIDs []string
 	bot.guildPresencesMutex.Lock()
 	for index := range bot.guildPresences[g.ID] {
-		/*
-			// Seems to be always empty right now...
-			for _, role := range bot.guildPresences[g.ID][index].Roles {
-				_, ok := rolesStruct[role]
-
-				if !ok {
-					dRole, err := s.State.Role(g.ID, role)
-					if err != nil {
-						log.Errorln("Could not get discord role")
-						return
-					}
-
-					rolesStruct[role] = dRole
-				}
-				log.Noteln(rolesStruct[role].Name)
-				online["role"][rolesStruct[role].Name]++
-			}
-		*/
-
 		online["status"][string(bot.guildPresences[g.ID][index].Status)]++
-		if bot.guildPresences[g.ID][index].Game != nil {
-			online["game"][bot.guildPresences[g.ID][index].Game.Name]++
+		if game := bot.guildPresences[g.ID][index].Game; game != nil && game.Type == discordgo.GameTypeGame {
+			online["game"][gameTag(game.Name)]++
+		}
+
+		if bot.guildPresences[g.ID][index].Status != discordgo.StatusOffline {
+			onlineIDs = append(onlineIDs, index)
 		}
 	}
 	bot.guildPresencesMutex.Unlock()
 
+	bot.recordOnline(g.ID, len(onlineIDs))
+
+	// Presences don't contain roles, so get them from the member cache
+	for _, discordID := range onlineIDs {
+		member := bot.members.get(g.ID, discordID)
+		if member == nil {
+			continue
+		}
+
+		for _, role := range member.Roles {
+			if dRole, ok := rolesStruct[role]; ok {
+				online["role"][dRole.Name]++
+			}
+		}
+	}
+
 	tags := map[string]string{"metric": "total_members", "server": g.Name}
-	bot.guildMembersMutex.Lock()
 	bot.guildPresencesMutex.Lock()
 	fields := map[string]interface{}{
-		"totalMembers":  len(bot.guildMembers[g.ID]),
+		"totalMembers":  bot.members.count(g.ID),
 		"onlineMembers": len(bot.guildPresences[g.ID]),
 	}
 	bot.guildPresencesMutex.Unlock()
-	bot.guildMembersMutex.Unlock()
 
-	err := bot.iDB.AddMetric("discord_metrics", tags, fields)
-	if err != nil {
-		log.Errorln("Error adding Metric:", err)
-	}
+	bot.addMetric("discord_metrics", tags, fields)
 
 	for roleName := range roles {
 		tags := map[string]string{"metric": "role_members", "server": g.Name, "roleName": roleName}
 		fields := map[string]interface{}{
-			"totalMembers": roles[roleName],
-			//"onlineMembers": online["roles"][roleName],
+			"totalMembers":  roles[roleName],
+			"onlineMembers": online["role"][roleName],
 		}
 
-		err := bot.iDB.AddMetric("discord_metrics", tags, fields)
-		if err != nil {
-			log.Errorln("Error adding Metric:", err)
-		}
+		bot.addMetric("discord_metrics", tags, fields)
 	}
 
 	for status := range online["status"] {
@@ -901,26 +1299,39 @@ func (bot *AwakenBot) metricGuild(s *discordgo.Session, g *discordgo.Guild) {
 			"onlineMembers": online["status"][status],
 		}
 
-		err := bot.iDB.AddMetric("discord_metrics", tags, fields)
-		if err != nil {
-			log.Errorln("Error adding Metric:", err)
-		}
+		bot.addMetric("discord_metrics", tags, fields)
 	}
 
-	/*for game := range online["game"] {
+	playing := 0
+	for game := range online["game"] {
 		tags := map[string]string{"metric": "game_members", "server": g.Name, "game": game}
 		fields := map[string]interface{}{
 			"onlineMembers": online["game"][game],
 		}
 
-		err := bot.iDB.AddMetric("discord_metrics", tags, fields)
-		if err != nil {
-			log.Errorln("Error adding Metric:", err)
-		}
-	}*/
+		bot.addMetric("discord_metrics", tags, fields)
+		playing += online["game"][game]
+	}
+
+	ownGame := 0
+	if MyConfig.OwnGame != "" {
+		ownGame = online["game"][MyConfig.OwnGame]
+	}
+
+	tags = map[string]string{"metric": "game_activity", "server": g.Name}
+	fields = map[string]interface{}{
+		"ownGame":    ownGame,
+		"otherGames": playing - ownGame,
+	}
+
+	bot.addMetric("discord_metrics", tags, fields)
+
+	bot.metricMemberEvents(g)
+	bot.metricChannels(s, g)
 }
 
 func (bot *AwakenBot) getAllMembers(s *discordgo.Session, g *discordgo.Guild) {
+	bot.members.startLoad(g.ID)
 	err := s.RequestGuildMembers(g.ID, "", 0)
 	if err != nil {
 		log.Errorln(err)
@@ -928,11 +1339,25 @@ func (bot *AwakenBot) getAllMembers(s *discordgo.Session, g *discordgo.Guild) {
 }
 
 // Create metrics about a guild
-func (bot *AwakenBot) guildMembersChunk(s *discordgo.Session, c *discordgo.GuildMembersChunk) {
+func (bot *AwakenBot) guildMembersChunk(s *discordgo.Session, event *discordgo.Event) {
+	if event.Type != "GUILD_MEMBERS_CHUNK" {
+		return
+	}
+
+	c, err := parseMemberChunk(event)
+	if err != nil {
+		log.Errorln("Could not decode member chunk", err.Error())
+		return
+	}
+
 	log.Noteln(len(c.Members))
-	bot.jobsChan <- botJob{
-		jobType:      "addMembers",
-		data:         c.Members,
-		discordGuild: c.GuildID,
+	select {
+	case bot.chunksChan <- c:
+	default:
+		// Don't block the gateway, the next full refresh fixes the cache
+		log.Errorln("Dropped member chunk of", c.GuildID, "- chunk queue is full")
+		bot.jobsMutex.Lock()
+		bot.droppedJobs["addMembers"]++
+		bot.jobsMutex.Unlock()
 	}
 }
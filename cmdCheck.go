@@ -10,14 +10,14 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func (bot *AwakenBot) cmdCheck(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) {
+func (bot *AwakenBot) cmdCheck(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
 
 	// Find the member from the message
 	member, err := s.State.Member(g.ID, m.Author.ID)
 	if err != nil {
 		// Could not find member.
 		log.Errorln("Could not find member", err)
-		return
+		return outcomeInternal
 	}
 
 	allowed := false
@@ -33,39 +33,39 @@ func (bot *AwakenBot) cmdCheck(s *discordgo.Session, c *discordgo.Channel, g *di
 
 	if !allowed {
 		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
-		return
+		return outcomeDenied
 	}
 
 	if len(args) != 1 {
 		bot.send(member.User.ID, "Please use "+bot.prefix+" check USER", c, g, s)
-		return
+		return outcomeUsage
 	}
 
 	userID, err := bot.getUserID(args[0], s, g)
 	if err != nil {
 		bot.send(member.User.ID, "Could not detect user. Please try again. "+err.Error(), c, g, s)
-		return
+		return outcomeUsage
 	}
 
 	log.Debugln(userID)
 
-	bot.discordStats(userID, c, s, g, m, member)
+	return bot.discordStats(userID, c, s, g, m, member)
 }
 
-func (bot *AwakenBot) discordStats(identifier string, c *discordgo.Channel, s *discordgo.Session, g *discordgo.Guild, m *discordgo.MessageCreate, member *discordgo.Member) {
+func (bot *AwakenBot) discordStats(identifier string, c *discordgo.Channel, s *discordgo.Session, g *discordgo.Guild, m *discordgo.MessageCreate, member *discordgo.Member) string {
 	var err error
 	var id, username, email, birthday, ipAddress, discordName, discordEmail, discordDiscriminator, discordID sql.NullString
 	err = bot.GetUserWithDiscord.QueryRow(identifier).Scan(&id, &username, &email, &birthday, &ipAddress, &discordName, &discordEmail, &discordDiscriminator, &discordID)
 	if err != nil {
 		bot.send(member.User.ID, "Could get user info. Please try again. "+err.Error(), c, g, s)
-		return
+		return outcomeUsage
 	}
 
 	rows, err := bot.GetUserRolesByID.Query(identifier)
 	defer rows.Close()
 	if err != nil {
 		bot.send(member.User.ID, "Could get user roles. Please try again. "+err.Error(), c, g, s)
-		return
+		return outcomeInternal
 	}
 
 	roles := []string{}
@@ -97,7 +97,10 @@ func (bot *AwakenBot) discordStats(identifier string, c *discordgo.Channel, s *d
 	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed)
 	if err != nil {
 		log.Errorln(err)
+		return outcomeInternal
 	}
+
+	return outcomeSuccess
 }
 
 func (bot *AwakenBot) getUserID(userString string, s *discordgo.Session, g *discordgo.Guild) (string, error) {
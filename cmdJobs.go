@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	// Amount of failed jobs shown by the jobs command
+	cmdJobsFailures = 5
+	// Amount of scheduled jobs shown by the jobs command
+	cmdJobsScheduled = 20
+)
+
+func (bot *AwakenBot) cmdJobs(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
+
+	// Find the member from the message
+	member, err := s.State.Member(g.ID, m.Author.ID)
+	if err != nil {
+		// Could not find member.
+		log.Errorln("Could not find member", err)
+		return outcomeInternal
+	}
+
+	if !bot.hasRole(g, member, "awokenlead", "awokendev", "staff") {
+		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
+		return outcomeDenied
+	}
+
+	if len(args) == 1 && args[0] == "scheduled" {
+		return bot.cmdJobsScheduled(s, m)
+	}
+
+	if len(args) == 2 && args[0] == "cancel" {
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+		if err != nil {
+			bot.send(member.User.ID, "Please use "+bot.prefix+" jobs cancel ID", c, g, s)
+			return outcomeUsage
+		}
+
+		cancelled, err := bot.cancelJob(id)
+		if err != nil {
+			log.Errorln("Could not cancel job", id, err.Error())
+			bot.send(member.User.ID, "Could not cancel job. "+err.Error(), c, g, s)
+			return outcomeInternal
+		}
+
+		if !cancelled {
+			bot.send(member.User.ID, "There is no scheduled job #"+args[1], c, g, s)
+			return outcomeUsage
+		}
+
+		log.Noteln(member.User.Username, "cancelled job", id)
+		bot.send(member.User.ID, "Cancelled job #"+args[1], c, g, s)
+		return outcomeSuccess
+	}
+
+	if len(args) != 0 {
+		bot.send(member.User.ID, "Please use "+bot.prefix+" jobs [scheduled|cancel ID]", c, g, s)
+		return outcomeUsage
+	}
+
+	embed := NewEmbed().
+		SetTitle("Jobs").
+		AddField("Queued", strconv.Itoa(len(bot.jobsChan)))
+
+	running := ""
+	bot.jobsMutex.Lock()
+	for queued, startedAt := range bot.runningJobs {
+		running += jobDescription(queued.id, queued.job) + " since " + time.Since(startedAt).Truncate(time.Second).String() + "\n"
+	}
+	bot.jobsMutex.Unlock()
+	embed.AddField("Running", running)
+
+	failed := ""
+	bot.failedJobsMutex.Lock()
+	for index := len(bot.failedJobs) - 1; index >= 0 && index >= len(bot.failedJobs)-cmdJobsFailures; index-- {
+		failedJob := bot.failedJobs[index]
+		failed += jobDescription(failedJob.id, failedJob.job) + " " + failedJob.failedAt.Format("02.01. 15:04") + ": " + failedJob.err.Error() + "\n"
+	}
+	bot.failedJobsMutex.Unlock()
+	embed.AddField("Recent failures", failed)
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed.SetColor(0x00ff00).MessageEmbed)
+	if err != nil {
+		log.Errorln(err)
+		return outcomeInternal
+	}
+
+	return outcomeSuccess
+}
+
+// jobDescription returns a short human readable description of a job
+func jobDescription(id int64, job botJob) string {
+	description := job.Type() + " on " + job.Guild()
+	if id != 0 {
+		description = "#" + strconv.FormatInt(id, 10) + " " + description
+	}
+
+	return description
+}
+
+// cmdJobsScheduled lists the next scheduled jobs
+func (bot *AwakenBot) cmdJobsScheduled(s *discordgo.Session, m *discordgo.MessageCreate) string {
+	rows, err := bot.GetScheduledJobs.Query(jobScheduled, cmdJobsScheduled)
+	if err != nil {
+		log.Errorln("Could not get scheduled jobs", err.Error())
+		return outcomeInternal
+	}
+	defer rows.Close()
+
+	scheduled := ""
+	for rows.Next() {
+		var id, runAt int64
+		var jobType, guildID, payload string
+
+		err := rows.Scan(&id, &jobType, &guildID, &payload, &runAt)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		scheduled += "#" + strconv.FormatInt(id, 10) + " " + jobType + " " + payload + " on " + guildID + " at " + time.Unix(runAt, 0).Format("02.01. 15:04") + "\n"
+	}
+
+	embed := NewEmbed().
+		SetTitle("Scheduled jobs").
+		SetDescription(scheduled).
+		SetColor(0x00ff00).
+		MessageEmbed
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed)
+	if err != nil {
+		log.Errorln(err)
+		return outcomeInternal
+	}
+
+	return outcomeSuccess
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func (bot *AwakenBot) cmdRefresh(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
+	err := bot.DB.Ping()
+	if err != nil {
+		log.Errorln("Error with database: ", err.Error())
+		return outcomeInternal
+	}
+
+	args, guilds := bot.commandGuilds(args, g, s)
+
+	if len(args) == 0 {
+		if len(guilds) > 1 {
+			guilds, err = bot.memberGuilds(m.Author.ID, s)
+			if err == errMembersLoading {
+				bot.send(m.Author.ID, "The member list is still loading. Please try again in a few minutes.", c, g, s)
+				return outcomeRetry
+			}
+		}
+
+		err := bot.refreshUserChannel(context.Background(), m.Author.ID, c, guilds, false, s)
+		if err != nil {
+			bot.send(m.Author.ID, "Not all of your roles could be synced. Please try again later.", c, g, s)
+			if isRetryable(err) {
+				return outcomeRetry
+			}
+			return outcomeInternal
+		}
+		return outcomeSuccess
+	}
+
+	// Find the member from the message
+	member, err := s.State.Member(g.ID, m.Author.ID)
+	if err != nil {
+		// Could not find member.
+		log.Errorln("Could not find member", err)
+		return outcomeInternal
+	}
+
+	if !bot.hasRole(g, member, "awokenlead", "awokendev", "staff", "communitymanager") {
+		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
+		return outcomeDenied
+	}
+
+	if len(args) != 1 {
+		bot.send(member.User.ID, "Please use "+bot.prefix+" refresh USER ["+allGuildsFlag+"]", c, g, s)
+		return outcomeUsage
+	}
+
+	userID, err := bot.getUserID(args[0], s, g)
+	if err != nil {
+		bot.send(member.User.ID, "Could not detect user. Please try again. "+err.Error(), c, g, s)
+		return outcomeUsage
+	}
+
+	var discordID string
+	err = bot.GetDiscordIDByID.QueryRow(userID).Scan(&discordID)
+	if err != nil {
+		log.Errorln("Could not find discordID")
+		bot.send(member.User.ID, "Could not find discordID. "+err.Error(), c, g, s)
+		return outcomeUsage
+	}
+
+	embed := NewEmbed().
+		SetTitle("Refreshed " + args[0])
+
+	for _, guild := range guilds {
+		if _, err := s.State.Member(guild.ID, discordID); err != nil {
+			embed.AddField(guild.Name, "Not a member")
+			continue
+		}
+
+		count, err := bot.refreshMember(context.Background(), discordID, guild, s)
+		switch {
+		case err == errNotLinked:
+			embed.AddField(guild.Name, "Not linked")
+		case err != nil:
+			embed.AddField(guild.Name, "Failed: "+err.Error())
+		default:
+			embed.AddField(guild.Name, "Synced "+strconv.Itoa(count)+" roles")
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed.SetColor(0x00ff00).InlineAllFields().MessageEmbed)
+	if err != nil {
+		log.Errorln(err)
+		return outcomeInternal
+	}
+
+	return outcomeSuccess
+}
@@ -6,14 +6,14 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func (bot *AwakenBot) cmdRemovePlayer(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) {
+func (bot *AwakenBot) cmdRemovePlayer(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
 
 	// Find the member from the message
 	member, err := s.State.Member(g.ID, m.Author.ID)
 	if err != nil {
 		// Could not find member.
 		log.Errorln("Could not find member", err)
-		return
+		return outcomeInternal
 	}
 
 	allowed := false
@@ -29,18 +29,20 @@ func (bot *AwakenBot) cmdRemovePlayer(s *discordgo.Session, c *discordgo.Channel
 
 	if !allowed {
 		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
-		return
+		return outcomeDenied
 	}
 
+	args, guilds := bot.commandGuilds(args, g, s)
+
 	if len(args) != 1 {
-		bot.send(member.User.ID, "Please use "+bot.prefix+" removePlayer USER", c, g, s)
-		return
+		bot.send(member.User.ID, "Please use "+bot.prefix+" removePlayer USER ["+allGuildsFlag+"]", c, g, s)
+		return outcomeUsage
 	}
 
 	userID, err := bot.getUserID(args[0], s, g)
 	if err != nil {
 		bot.send(member.User.ID, "Could not detect user. Please try again. "+err.Error(), c, g, s)
-		return
+		return outcomeUsage
 	}
 
 	// Remove Role from website
@@ -56,11 +58,46 @@ func (bot *AwakenBot) cmdRemovePlayer(s *discordgo.Session, c *discordgo.Channel
 	if err != nil {
 		log.Errorln("Could not find discordID")
 		bot.send(member.User.ID, "Could not find discordID. "+err.Error(), c, g, s)
-		return
+		return outcomeUsage
 	}
 
 	// Remove discord role
-	s.GuildMemberRoleRemove(g.ID, discordID, bot.rolesToIDMap[g.ID]["tester"])
+	if len(guilds) == 1 {
+		s.GuildMemberRoleRemove(g.ID, discordID, bot.rolesToIDMap[g.ID]["tester"])
+
+		bot.send(member.User.ID, "Removed Player role from user.", c, g, s)
+		return outcomeSuccess
+	}
+
+	embed := NewEmbed().
+		SetTitle("Removed Player role from " + args[0])
+
+	for _, guild := range guilds {
+		roleID, ok := bot.rolesToIDMap[guild.ID]["tester"]
+		if !ok {
+			embed.AddField(guild.Name, "No Player role")
+			continue
+		}
+
+		if _, err := s.State.Member(guild.ID, discordID); err != nil {
+			embed.AddField(guild.Name, "Not a member")
+			continue
+		}
+
+		err = s.GuildMemberRoleRemove(guild.ID, discordID, roleID)
+		if err != nil {
+			embed.AddField(guild.Name, "Failed: "+err.Error())
+			continue
+		}
+
+		embed.AddField(guild.Name, "Removed")
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed.SetColor(0x00ff00).InlineAllFields().MessageEmbed)
+	if err != nil {
+		log.Errorln(err)
+		return outcomeInternal
+	}
 
-	bot.send(member.User.ID, "Removed Player role from user.", c, g, s)
+	return outcomeSuccess
 }
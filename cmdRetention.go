@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func (bot *AwakenBot) cmdRetention(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
+
+	// Find the member from the message
+	member, err := s.State.Member(g.ID, m.Author.ID)
+	if err != nil {
+		// Could not find member.
+		log.Errorln("Could not find member", err)
+		return outcomeInternal
+	}
+
+	if !bot.hasRole(g, member, "awokenlead", "awokendev", "staff") {
+		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
+		return outcomeDenied
+	}
+
+	if len(args) != 0 {
+		bot.send(member.User.ID, "Please use "+bot.prefix+" retention", c, g, s)
+		return outcomeUsage
+	}
+
+	stats, err := bot.retention(context.Background(), g.ID)
+	if err != nil {
+		bot.send(member.User.ID, "Could not calculate the retention. "+err.Error(), c, g, s)
+		return outcomeInternal
+	}
+
+	embed := NewEmbed().
+		SetTitle("Retention on " + g.Name).
+		SetDescription("Members of the last 30 days that are still around")
+
+	for _, stat := range stats {
+		name := strconv.Itoa(stat.days) + " days, unlinked"
+		if stat.linked {
+			name = strconv.Itoa(stat.days) + " days, linked"
+		}
+
+		embed.AddField(name, strconv.Itoa(stat.retained)+"/"+strconv.Itoa(stat.joined)+" ("+strconv.Itoa(int(stat.rate()*100))+"%)")
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed.SetColor(0x00ff00).InlineAllFields().MessageEmbed)
+	if err != nil {
+		log.Errorln(err)
+		return outcomeInternal
+	}
+
+	return outcomeSuccess
+}
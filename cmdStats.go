@@ -8,14 +8,14 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func (bot *AwakenBot) cmdStats(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) {
+func (bot *AwakenBot) cmdStats(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
 
 	// Find the member from the message
 	member, err := s.State.Member(g.ID, m.Author.ID)
 	if err != nil {
 		// Could not find member.
 		log.Errorln("Could not find member", err)
-		return
+		return outcomeInternal
 	}
 
 	if len(args) == 1 {
@@ -23,7 +23,7 @@ func (bot *AwakenBot) cmdStats(s *discordgo.Session, c *discordgo.Channel, g *di
 		userID, err := bot.getUserID(args[0], s, g)
 		if err != nil {
 			bot.send(member.User.ID, "Could not detect user. Please try again. "+err.Error(), c, g, s)
-			return
+			return outcomeUsage
 		}
 
 		var discordID string
@@ -31,14 +31,14 @@ func (bot *AwakenBot) cmdStats(s *discordgo.Session, c *discordgo.Channel, g *di
 		if err != nil {
 			log.Errorln("Could not find discordID")
 			bot.send(member.User.ID, "Could not find discordID. "+err.Error(), c, g, s)
-			return
+			return outcomeUsage
 		}
 
 		member, err = s.State.Member(g.ID, discordID)
 		if err != nil {
 			// Could not find member.
 			log.Errorln("Could not find member", err)
-			return
+			return outcomeInternal
 		}
 	}
 
@@ -46,6 +46,7 @@ func (bot *AwakenBot) cmdStats(s *discordgo.Session, c *discordgo.Channel, g *di
 	rows, err := bot.GetStatsByDiscordID.Query(member.User.ID)
 	if err != nil {
 		log.Errorln("Failed gettings stats for discord-id "+member.User.ID, err.Error())
+		return outcomeInternal
 	}
 
 	for rows.Next() {
@@ -110,6 +111,9 @@ func (bot *AwakenBot) cmdStats(s *discordgo.Session, c *discordgo.Channel, g *di
 		_, err := s.ChannelMessageSendEmbed(m.ChannelID, embed)
 		if err != nil {
 			log.Errorln(err)
+			return outcomeInternal
 		}
 	}
+
+	return outcomeSuccess
 }
@@ -8,14 +8,14 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func (bot *AwakenBot) cmdSync(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) {
+func (bot *AwakenBot) cmdSync(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
 
 	// Find the member from the message
 	member, err := s.State.Member(g.ID, m.Author.ID)
 	if err != nil {
 		// Could not find member.
 		log.Errorln("Could not find member", err)
-		return
+		return outcomeInternal
 	}
 
 	allowed := false
@@ -28,37 +28,93 @@ func (bot *AwakenBot) cmdSync(s *discordgo.Session, c *discordgo.Channel, g *dis
 
 	if !allowed {
 		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
-		return
+		return outcomeDenied
 	}
 
+	args, guilds := bot.commandGuilds(args, g, s)
+
 	if len(args) != 1 {
-		bot.send(member.User.ID, "Please use "+bot.prefix+" syncRole ROLENAME", c, g, s)
-		return
+		bot.send(member.User.ID, "Please use "+bot.prefix+" syncRole ROLENAME ["+allGuildsFlag+"]", c, g, s)
+		return outcomeUsage
+	}
+
+	// With --all-guilds it's enough if one guild knows the role, the others
+	// are listed as unknown
+	known := false
+	for _, guild := range guilds {
+		if _, ok := bot.rolesToIDMap[guild.ID][args[0]]; ok {
+			known = true
+			break
+		}
 	}
 
-	if _, ok := bot.rolesToIDMap[g.ID][args[0]]; !ok {
+	if !known {
 		bot.send(member.User.ID, "Unknown role", c, g, s)
-		return
+		return outcomeUsage
 	}
 
 	var id, title, slug string
 	err = bot.GetRoleBySlug.QueryRow(args[0]).Scan(&id, &title, &slug)
 	if err != nil {
 		log.Noteln("Could not get role!", err)
-		return
+		return outcomeInternal
+	}
+
+	embed := NewEmbed().
+		SetTitle("Assigned " + args[0] + " on the homepage")
+
+	total := 0
+	var syncErr error
+	for _, guild := range guilds {
+		roleID, ok := bot.rolesToIDMap[guild.ID][args[0]]
+		if !ok {
+			embed.AddField(guild.Name, "Unknown role")
+			continue
+		}
+
+		members := bot.getMembersByRole(roleID, guild)
+		if len(members) == 0 {
+			embed.AddField(guild.Name, "0 members")
+			continue
+		}
+
+		var queryArgs []interface{}
+		queryArgs = append(queryArgs, id)
+		for _, member := range members {
+			queryArgs = append(queryArgs, member.User.ID)
+		}
+
+		_, err = bot.updateUsersByDiscordId(len(members)).Exec(queryArgs...)
+		if err != nil {
+			log.Errorln("Failed setting all roles for members", err.Error())
+			embed.AddField(guild.Name, "Failed: "+err.Error())
+			syncErr = err
+			continue
+		}
+
+		embed.AddField(guild.Name, strconv.Itoa(len(members))+" members")
+		total += len(members)
 	}
 
-	members := bot.getMembersByRole(bot.rolesToIDMap[g.ID][args[0]], g)
-	var queryArgs []interface{}
-	queryArgs = append(queryArgs, id)
-	for _, member := range members {
-		queryArgs = append(queryArgs, member.User.ID)
+	if len(guilds) == 1 {
+		if syncErr != nil {
+			bot.send(member.User.ID, "Could not assign "+args[0]+". "+syncErr.Error(), c, g, s)
+			return outcomeInternal
+		}
+
+		bot.send(member.User.ID, "Assigned "+args[0]+" to "+strconv.Itoa(total)+" members", c, g, s)
+		return outcomeSuccess
 	}
 
-	_, err = bot.updateUsersByDiscordId(len(members)).Exec(queryArgs...)
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, embed.SetColor(0x00ff00).InlineAllFields().MessageEmbed)
 	if err != nil {
-		log.Errorln("Failed setting all roles for members", err.Error())
+		log.Errorln(err)
+		return outcomeInternal
+	}
+
+	if syncErr != nil {
+		return outcomeInternal
 	}
 
-	bot.send(member.User.ID, "Assigned "+args[0]+" to "+strconv.Itoa(len(members))+" members", c, g, s)
+	return outcomeSuccess
 }
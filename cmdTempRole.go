@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func (bot *AwakenBot) cmdTempRole(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
+
+	// Find the member from the message
+	member, err := s.State.Member(g.ID, m.Author.ID)
+	if err != nil {
+		// Could not find member.
+		log.Errorln("Could not find member", err)
+		return outcomeInternal
+	}
+
+	if !bot.hasRole(g, member, "awokenlead", "awokendev", "staff", "communitymanager") {
+		bot.send(member.User.ID, "You are not allowed to run this function", c, g, s)
+		return outcomeDenied
+	}
+
+	if len(args) != 3 {
+		bot.send(member.User.ID, "Please use "+bot.prefix+" tempRole USER ROLENAME DAYS", c, g, s)
+		return outcomeUsage
+	}
+
+	roleID, ok := bot.rolesToIDMap[g.ID][args[1]]
+	if !ok {
+		bot.send(member.User.ID, "Unknown role", c, g, s)
+		return outcomeUsage
+	}
+
+	days, err := strconv.Atoi(args[2])
+	if err != nil || days < 1 {
+		bot.send(member.User.ID, "Please use "+bot.prefix+" tempRole USER ROLENAME DAYS", c, g, s)
+		return outcomeUsage
+	}
+
+	userID, err := bot.getUserID(args[0], s, g)
+	if err != nil {
+		bot.send(member.User.ID, "Could not detect user. Please try again. "+err.Error(), c, g, s)
+		return outcomeUsage
+	}
+
+	var discordID string
+	err = bot.GetDiscordIDByID.QueryRow(userID).Scan(&discordID)
+	if err != nil {
+		log.Errorln("Could not find discordID")
+		bot.send(member.User.ID, "Could not find discordID. "+err.Error(), c, g, s)
+		return outcomeUsage
+	}
+
+	err = s.GuildMemberRoleAdd(g.ID, discordID, roleID)
+	if err != nil {
+		bot.send(member.User.ID, "Could not assign role. "+err.Error(), c, g, s)
+		return outcomeInternal
+	}
+
+	removeAt := time.Now().Add(time.Hour * 24 * time.Duration(days))
+	id, err := bot.schedule(removeRoleJob{guildID: g.ID, discordID: discordID, slug: args[1]}, removeAt)
+	if err != nil {
+		bot.send(member.User.ID, "Assigned "+args[1]+" but could not schedule the removal. "+err.Error(), c, g, s)
+		return outcomeInternal
+	}
+
+	bot.send(member.User.ID, "Assigned "+args[1]+" until "+removeAt.Format("02.01.2006 15:04")+" (job #"+strconv.FormatInt(id, 10)+")", c, g, s)
+	return outcomeSuccess
+}
@@ -24,6 +24,53 @@ type Config struct {
 	RemoteAddr       string
 	UseSshTunnel     bool
 	DiscordToken     string
+
+	// Where metrics go, comma separated: influx, prometheus, both, statsd,
+	// file or none
+	MetricsBackend string
+	// Address of the statsd server, e.g. 127.0.0.1:8125
+	StatsdAddr string
+	// File the file sink appends JSON lines to
+	MetricsFile string
+	// File influx metrics are kept in while influx is down, empty to disable
+	MetricsSpool string
+	// Size limit of the spool in megabytes, newer metrics are dropped
+	MetricsSpoolMaxMB int
+	// Spooled metrics older than that are dropped
+	MetricsSpoolMaxHours int
+
+	// Name of our game as discord shows it
+	OwnGame string
+	// Other games tracked by name, all others are grouped as "other"
+	GameAllowList []string
+
+	// Hours a member may keep managed roles without a linked account
+	UnlinkedGraceHours int
+	// Minutes between two reconciliation runs per guild
+	ReconcileMinutes int
+	// Minutes between two full member reloads, events keep the cache up to
+	// date in between. 0 disables them.
+	MemberResyncMinutes int
+
+	// Nickname template, supports {username} and {mainHero}
+	NickTemplate string
+	// Role slugs whose members keep their own nickname
+	NickExemptRoles []string
+
+	// Retries of a failed job before it's given up
+	JobMaxRetries int
+	// Amount of jobs processed at the same time
+	JobWorkers int
+
+	// Keys allowed to use the HTTP API
+	APIKeys []APIKey
+
+	// How often the digest is posted: daily, weekly or empty to disable
+	DigestInterval string
+	// ID of the staff channel the digest is posted to
+	DigestChannel string
+	// Hour of the day (UTC) the digest is posted, weekly ones on mondays
+	DigestHour int
 }
 
 func (config *Config) Parse(data []byte) error {
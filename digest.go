@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// Digest intervals selectable in the config
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// Amount of channels listed as most active
+const digestTopChannels = 5
+
+// digestStats collects everything for the next digest we don't store in
+// the database
+type digestStats struct {
+	since      time.Time
+	peakOnline int
+	messages   map[string]int
+	newTesters int
+}
+
+func newDigestStats() *digestStats {
+	return &digestStats{
+		since:    time.Now(),
+		messages: make(map[string]int),
+	}
+}
+
+// merge adds older stats that could not be sent
+func (stats *digestStats) merge(older *digestStats) {
+	if older.since.Before(stats.since) {
+		stats.since = older.since
+	}
+	if older.peakOnline > stats.peakOnline {
+		stats.peakOnline = older.peakOnline
+	}
+	for channelID, messages := range older.messages {
+		stats.messages[channelID] += messages
+	}
+	stats.newTesters += older.newTesters
+}
+
+// digestFor returns the digest stats of a guild, the digest lock has to be held
+func (bot *AwakenBot) digestFor(guildID string) *digestStats {
+	stats, ok := bot.digests[guildID]
+	if !ok {
+		stats = newDigestStats()
+		bot.digests[guildID] = stats
+	}
+
+	return stats
+}
+
+// recordOnline remembers the highest amount of online members
+func (bot *AwakenBot) recordOnline(guildID string, online int) {
+	bot.digestMutex.Lock()
+	stats := bot.digestFor(guildID)
+	if online > stats.peakOnline {
+		stats.peakOnline = online
+	}
+	bot.digestMutex.Unlock()
+}
+
+// recordChannelMessages adds the messages of a metrics interval
+func (bot *AwakenBot) recordChannelMessages(guildID string, channelID string, messages int) {
+	bot.digestMutex.Lock()
+	bot.digestFor(guildID).messages[channelID] += messages
+	bot.digestMutex.Unlock()
+}
+
+// recordNewTester counts members that got the tester role
+func (bot *AwakenBot) recordNewTester(guildID string) {
+	bot.digestMutex.Lock()
+	bot.digestFor(guildID).newTesters++
+	bot.digestMutex.Unlock()
+}
+
+// digestPeriod returns how much time a digest covers
+func digestPeriod() time.Duration {
+	if MyConfig.DigestInterval == digestWeekly {
+		return time.Hour * 24 * 7
+	}
+
+	return time.Hour * 24
+}
+
+// nextDigest returns when the next digest is due, weekly ones are posted on mondays
+func nextDigest(now time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), MyConfig.DigestHour, 0, 0, 0, time.UTC)
+	for !next.After(now) || (MyConfig.DigestInterval == digestWeekly && next.Weekday() != time.Monday) {
+		next = next.Add(time.Hour * 24)
+	}
+
+	return next
+}
+
+// digestEnabled checks if a valid digest interval is configured
+func digestEnabled() bool {
+	return MyConfig.DigestInterval == digestDaily || MyConfig.DigestInterval == digestWeekly
+}
+
+// scheduleDigest stores the next digest as a job if the digest channel is on
+// that guild, unless it's scheduled already. Every digest job schedules the
+// next one, so restarts neither skip nor repeat a digest.
+func (bot *AwakenBot) scheduleDigest(guildID string, s *discordgo.Session) {
+	if !digestEnabled() {
+		return
+	}
+
+	channel, err := s.State.Channel(MyConfig.DigestChannel)
+	if err != nil || channel.GuildID != guildID {
+		return
+	}
+
+	next := nextDigest(time.Now())
+	id, err := bot.scheduleOnce(digestJob{guildID: guildID}, next)
+	if err != nil {
+		log.Errorln("Could not schedule digest", err.Error())
+		return
+	}
+
+	if id != 0 {
+		log.Noteln("Next digest at", next.String())
+	}
+}
+
+// postDigest sends the community digest of a guild to the staff channel
+func (bot *AwakenBot) postDigest(ctx context.Context, guild *discordgo.Guild, s *discordgo.Session) error {
+	since := time.Now().Add(-digestPeriod())
+
+	var joined, left int
+	err := bot.GetMemberEventCounts.QueryRowContext(ctx, guild.ID, since.Unix(), guild.ID, since.Unix()).Scan(&joined, &left)
+	if err != nil {
+		log.Errorln("Unable to get member events", err.Error())
+		return err
+	}
+
+	linked := "unavailable"
+	if bot.GetNewLinkCount != nil {
+		var count int
+		err = bot.GetNewLinkCount.QueryRowContext(ctx, since.Unix()).Scan(&count)
+		if err != nil && isRetryable(err) {
+			return err
+		}
+		if err != nil {
+			log.Errorln("Unable to get new links", err.Error())
+		} else {
+			linked = strconv.Itoa(count)
+		}
+	}
+
+	// New stats are collected from now on, these are merged back if the
+	// digest can't be sent
+	bot.digestMutex.Lock()
+	stats := bot.digestFor(guild.ID)
+	bot.digests[guild.ID] = newDigestStats()
+	bot.digestMutex.Unlock()
+
+	var slugs []string
+	for slug := range bot.rolesToIDMap[guild.ID] {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	roles := ""
+	for _, slug := range slugs {
+		roles += slug + ": " + strconv.Itoa(len(bot.getMembersByRole(bot.rolesToIDMap[guild.ID][slug], guild))) + "\n"
+	}
+
+	var channelIDs []string
+	for channelID := range stats.messages {
+		if stats.messages[channelID] > 0 {
+			channelIDs = append(channelIDs, channelID)
+		}
+	}
+	sort.Slice(channelIDs, func(i, j int) bool {
+		return stats.messages[channelIDs[i]] > stats.messages[channelIDs[j]]
+	})
+	if len(channelIDs) > digestTopChannels {
+		channelIDs = channelIDs[:digestTopChannels]
+	}
+
+	channels := ""
+	for _, channelID := range channelIDs {
+		channels += "<#" + channelID + ">: " + strconv.Itoa(stats.messages[channelID]) + " messages\n"
+	}
+
+	title := "Daily digest"
+	if MyConfig.DigestInterval == digestWeekly {
+		title = "Weekly digest"
+	}
+
+	embed := NewEmbed().
+		SetTitle(title+" of "+guild.Name).
+		SetDescription("Since "+since.Format("02.01.2006 15:04")+"\nPeak online, channels and new players since "+stats.since.Format("02.01.2006 15:04")).
+		AddField("Joined", strconv.Itoa(joined)).
+		AddField("Left", strconv.Itoa(left)).
+		AddField("Newly linked", linked).
+		AddField("Peak online", strconv.Itoa(stats.peakOnline)).
+		AddField("New players", strconv.Itoa(stats.newTesters)).
+		AddField("Roles", strings.TrimSpace(roles)).
+		AddField("Most active channels", strings.TrimSpace(channels)).
+		SetColor(0x00ff00).
+		MessageEmbed
+
+	_, err = s.ChannelMessageSendEmbed(MyConfig.DigestChannel, embed)
+	if err != nil {
+		bot.digestMutex.Lock()
+		bot.digestFor(guild.ID).merge(stats)
+		bot.digestMutex.Unlock()
+		return err
+	}
+
+	return nil
+}
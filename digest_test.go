@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextDigest(t *testing.T) {
+	defer func(hour int, interval string) {
+		MyConfig.DigestHour = hour
+		MyConfig.DigestInterval = interval
+	}(MyConfig.DigestHour, MyConfig.DigestInterval)
+
+	// 2026-10-14 is a wednesday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		interval string
+		hour     int
+		now      time.Time
+		want     time.Time
+	}{
+		{digestDaily, 18, at(14, 12, 0), at(14, 18, 0)},
+		{digestDaily, 18, at(14, 18, 0), at(15, 18, 0)},
+		{digestDaily, 18, at(14, 20, 30), at(15, 18, 0)},
+		{digestDaily, 0, at(14, 23, 59), at(15, 0, 0)},
+		{digestWeekly, 18, at(14, 12, 0), at(19, 18, 0)},
+		{digestWeekly, 18, at(19, 12, 0), at(19, 18, 0)},
+		{digestWeekly, 18, at(19, 18, 0), at(26, 18, 0)},
+		{digestDaily, 18, time.Date(2026, time.December, 31, 19, 0, 0, 0, time.UTC), time.Date(2027, time.January, 1, 18, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		MyConfig.DigestInterval = test.interval
+		MyConfig.DigestHour = test.hour
+		if got := nextDigest(test.now); !got.Equal(test.want) {
+			t.Errorf("nextDigest(%s, %d, %s) = %s, want %s", test.interval, test.hour, test.now, got, test.want)
+		}
+	}
+}
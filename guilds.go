@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Flag for staff commands to run on every guild instead of the current one
+const allGuildsFlag = "--all-guilds"
+
+// managedGuilds returns all guilds we have a role mapping for
+func (bot *AwakenBot) managedGuilds(s *discordgo.Session) []*discordgo.Guild {
+	var guilds []*discordgo.Guild
+
+	for _, guildID := range bot.managedGuildIDs() {
+		guild, err := s.State.Guild(guildID)
+		if err != nil {
+			// Bot is not on that guild
+			continue
+		}
+
+		guilds = append(guilds, guild)
+	}
+
+	return guilds
+}
+
+// managedGuildIDs returns the IDs of all guilds we have a role mapping for
+func (bot *AwakenBot) managedGuildIDs() []string {
+	var guildIDs []string
+	for guildID := range bot.rolesToIDMap {
+		guildIDs = append(guildIDs, guildID)
+	}
+
+	return guildIDs
+}
+
+// memberGuilds returns all managed guilds a discord user is a member of.
+// It returns errMembersLoading if the user isn't found on a guild whose
+// member list is still loading, asking discord for every guild would block
+// the caller outside of the job queue.
+func (bot *AwakenBot) memberGuilds(discordID string, s *discordgo.Session) ([]*discordgo.Guild, error) {
+	var guilds []*discordgo.Guild
+	var err error
+
+	loaded := bot.members.loadedGuilds()
+	for _, guild := range bot.managedGuilds(s) {
+		if bot.members.get(guild.ID, discordID) != nil {
+			guilds = append(guilds, guild)
+			continue
+		}
+
+		if loaded[guild.ID] {
+			continue
+		}
+
+		// The state might know the member already
+		if _, stateErr := s.State.Member(guild.ID, discordID); stateErr == nil {
+			guilds = append(guilds, guild)
+			continue
+		}
+
+		err = errMembersLoading
+	}
+
+	return guilds, err
+}
+
+// commandGuilds strips the --all-guilds flag from the arguments and returns
+// the guilds a command should run on
+func (bot *AwakenBot) commandGuilds(args []string, g *discordgo.Guild, s *discordgo.Session) ([]string, []*discordgo.Guild) {
+	allGuilds := false
+	rest := []string{}
+	for _, arg := range args {
+		if arg == allGuildsFlag {
+			allGuilds = true
+			continue
+		}
+
+		rest = append(rest, arg)
+	}
+
+	if !allGuilds {
+		return rest, []*discordgo.Guild{g}
+	}
+
+	return rest, bot.managedGuilds(s)
+}
+
+// hasRole checks if a member holds one of the given role slugs
+func (bot *AwakenBot) hasRole(g *discordgo.Guild, member *discordgo.Member, slugs ...string) bool {
+	for _, value := range member.Roles {
+		for _, slug := range slugs {
+			if bot.rolesToIDMap[g.ID][slug] == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	// How long a single readiness check may take
+	healthCheckTimeout = time.Second * 2
+	// Discord sends heartbeats every ~41 seconds, so an older ack means the
+	// gateway connection is dead
+	healthHeartbeatMaxAge = time.Minute * 2
+)
+
+// healthCheck is the result of a single readiness check
+type healthCheck struct {
+	OK        bool              `json:"ok"`
+	LatencyMs float64           `json:"latencyMs,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// healthz tells if the process is alive
+func (bot *AwakenBot) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz tells if the bot can do its work
+func (bot *AwakenBot) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{
+		"database": bot.checkDatabase(r.Context()),
+		"gateway":  bot.checkGateway(),
+		"members":  bot.checkMembers(),
+		"metrics":  bot.checkMetrics(),
+	}
+
+	if MyConfig.UseSshTunnel {
+		checks["sshTunnel"] = bot.checkTunnel()
+	}
+
+	status := http.StatusOK
+	overall := "ok"
+	for _, check := range checks {
+		if !check.OK {
+			status = http.StatusServiceUnavailable
+			overall = "fail"
+		}
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"status": overall,
+		"checks": checks,
+	})
+}
+
+func (bot *AwakenBot) checkDatabase(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := bot.DB.PingContext(ctx)
+	check := healthCheck{
+		OK:        err == nil,
+		LatencyMs: time.Since(start).Seconds() * 1000,
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	return check
+}
+
+func (bot *AwakenBot) checkGateway() healthCheck {
+	bot.DG.RLock()
+	dataReady := bot.DG.DataReady
+	lastAck := bot.DG.LastHeartbeatAck
+	bot.DG.RUnlock()
+
+	check := healthCheck{
+		OK: true,
+		Details: map[string]string{
+			"lastHeartbeatAck": lastAck.Format(time.RFC3339),
+		},
+	}
+
+	if !dataReady {
+		check.OK = false
+		check.Error = "Gateway not connected"
+	} else if time.Since(lastAck) > healthHeartbeatMaxAge {
+		check.OK = false
+		check.Error = "Last heartbeat ack is " + time.Since(lastAck).Round(time.Second).String() + " old"
+	}
+
+	return check
+}
+
+func (bot *AwakenBot) checkMembers() healthCheck {
+	check := healthCheck{
+		OK:      true,
+		Details: map[string]string{},
+	}
+
+	// Guilds we don't manage don't keep the bot from working
+	loadedGuilds := bot.members.loadedGuilds()
+	for _, guildID := range bot.managedGuildIDs() {
+		loaded, ok := loadedGuilds[guildID]
+		if !ok {
+			// Bot is not on that guild
+			continue
+		}
+
+		if loaded {
+			check.Details[guildID] = "loaded"
+			continue
+		}
+
+		check.OK = false
+		check.Details[guildID] = "loading"
+	}
+
+	if len(check.Details) == 0 {
+		check.OK = false
+		check.Error = "No guilds available yet"
+	} else if !check.OK {
+		check.Error = "Member cache not fully loaded"
+	}
+
+	return check
+}
+
+func (bot *AwakenBot) checkMetrics() healthCheck {
+	bot.metricsMutex.Lock()
+	err := bot.lastMetricsError
+	failedAt := bot.lastMetricsErrorAt
+	bot.metricsMutex.Unlock()
+
+	check := healthCheck{OK: err == nil, Details: map[string]string{}}
+	if err != nil {
+		check.Error = err.Error()
+		check.Details["failedAt"] = failedAt.Format(time.RFC3339)
+	}
+
+	// Metrics are spooled without an error while influx is down. That's what
+	// the spool is for, so the bot stays ready.
+	if bot.spool != nil {
+		if depth := bot.spool.stats().depth; depth > 0 {
+			check.Details["spooled"] = strconv.Itoa(depth)
+		}
+	}
+
+	return check
+}
+
+func (bot *AwakenBot) checkTunnel() healthCheck {
+	start := time.Now()
+	err := checkTunnel(healthCheckTimeout)
+	check := healthCheck{
+		OK:        err == nil,
+		LatencyMs: time.Since(start).Seconds() * 1000,
+	}
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	return check
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxWriter writes points with their own timestamps using the influx
+// line protocol. The GoAwaken client always uses the current time, which
+// would squash replayed metrics into one burst.
+type influxWriter struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newInfluxWriter(host string, database string, user string, password string) *influxWriter {
+	return &influxWriter{
+		url:      strings.TrimRight(host, "/") + "/write?precision=ns&db=" + url.QueryEscape(database),
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// influxRejected is returned if influx refuses points for good, e.g. because
+// a field changed its type. Sending them again won't help.
+type influxRejected struct {
+	message string
+}
+
+func (e influxRejected) Error() string {
+	return e.message
+}
+
+// write sends points in a single request
+func (writer *influxWriter) write(points []spoolPoint) error {
+	var body bytes.Buffer
+	for _, point := range points {
+		if len(point.fields()) == 0 {
+			// Not a valid point, influx would reject the whole batch
+			continue
+		}
+		body.WriteString(point.line())
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, writer.url, &body)
+	if err != nil {
+		return err
+	}
+	if writer.user != "" {
+		req.SetBasicAuth(writer.user, writer.password)
+	}
+
+	res, err := writer.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(res.Body)
+		text := "influx write failed with " + res.Status + ": " + strings.TrimSpace(string(message))
+
+		switch res.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return influxRejected{text}
+		}
+		return errors.New(text)
+	}
+
+	return nil
+}
+
+var (
+	influxNameEscaper  = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper   = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// line renders a point in the influx line protocol
+func (point spoolPoint) line() string {
+	line := influxNameEscaper.Replace(point.Name)
+
+	var tagKeys []string
+	for key, value := range point.Tags {
+		// Influx rejects empty tag values
+		if value != "" {
+			tagKeys = append(tagKeys, key)
+		}
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		line += "," + influxKeyEscaper.Replace(key) + "=" + influxKeyEscaper.Replace(point.Tags[key])
+	}
+
+	var fields []string
+	for key, value := range point.Ints {
+		fields = append(fields, influxKeyEscaper.Replace(key)+"="+strconv.FormatInt(value, 10)+"i")
+	}
+	for key, value := range point.Floats {
+		fields = append(fields, influxKeyEscaper.Replace(key)+"="+strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	for key, value := range point.Bools {
+		fields = append(fields, influxKeyEscaper.Replace(key)+"="+strconv.FormatBool(value))
+	}
+	for key, value := range point.Strings {
+		fields = append(fields, influxKeyEscaper.Replace(key)+`="`+influxValueEscaper.Replace(value)+`"`)
+	}
+	sort.Strings(fields)
+
+	return line + " " + strings.Join(fields, ",") + " " + strconv.FormatInt(point.Time.UnixNano(), 10)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpoolPointLine(t *testing.T) {
+	at := time.Unix(1500000000, 42)
+
+	tests := []struct {
+		point spoolPoint
+		want  string
+	}{
+		{
+			spoolPoint{Time: at, Name: "members", Ints: map[string]int64{"count": 5}},
+			"members count=5i 1500000000000000042",
+		},
+		{
+			spoolPoint{
+				Time:   at,
+				Name:   "members",
+				Tags:   map[string]string{"guild": "1", "empty": "", "bot": "awaken"},
+				Ints:   map[string]int64{"online": 2},
+				Floats: map[string]float64{"ratio": 0.5},
+				Bools:  map[string]bool{"loaded": true},
+			},
+			"members,bot=awaken,guild=1 loaded=true,online=2i,ratio=0.5 1500000000000000042",
+		},
+		{
+			spoolPoint{
+				Time:    at,
+				Name:    "role count",
+				Tags:    map[string]string{"role name": "a,b=c"},
+				Strings: map[string]string{"title": `say "hi" \o/`},
+			},
+			`role\ count,role\ name=a\,b\=c title="say \"hi\" \\o/" 1500000000000000042`,
+		},
+	}
+
+	for _, test := range tests {
+		if got := test.point.line(); got != test.want {
+			t.Errorf("line() = %q, want %q", got, test.want)
+		}
+	}
+}
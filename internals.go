@@ -0,0 +1,139 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+)
+
+// This function will be called (due to AddHandler above) every time
+// discordgo hits a REST rate limit.
+func (bot *AwakenBot) rateLimit(s *discordgo.Session, event *discordgo.RateLimit) {
+	log.Noteln("Hit rate limit on", event.URL)
+
+	bot.metricsMutex.Lock()
+	bot.rateLimitHits++
+	bot.metricsMutex.Unlock()
+}
+
+// collectRuntimeMetrics sends metrics about the bot itself
+func (bot *AwakenBot) collectRuntimeMetrics() {
+	gcStats := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&gcStats)
+
+	tags := map[string]string{"metric": "runtime", "server": "global"}
+	fields := map[string]interface{}{
+		"goroutines":  runtime.NumGoroutine(),
+		"gcCount":     gcStats.NumGC,
+		"gcPauseMin":  gcStats.PauseQuantiles[0].Seconds(),
+		"gcPauseP25":  gcStats.PauseQuantiles[1].Seconds(),
+		"gcPauseP50":  gcStats.PauseQuantiles[2].Seconds(),
+		"gcPauseP75":  gcStats.PauseQuantiles[3].Seconds(),
+		"gcPauseMax":  gcStats.PauseQuantiles[4].Seconds(),
+		"gcPauseLast": 0.0,
+	}
+	if len(gcStats.Pause) > 0 {
+		fields["gcPauseLast"] = gcStats.Pause[0].Seconds()
+	}
+
+	bot.addMetric("server_metrics", tags, fields)
+
+	// Age of the oldest job that's waiting for a worker
+	oldest := time.Duration(0)
+	bot.jobsMutex.Lock()
+	for _, queued := range bot.pendingJobs {
+		if age := time.Since(queued.queuedAt); age > oldest {
+			oldest = age
+		}
+	}
+	bot.jobsMutex.Unlock()
+
+	tags = map[string]string{"metric": "job_queue", "server": "global"}
+	fields = map[string]interface{}{
+		"depth":          len(bot.jobsChan),
+		"capacity":       cap(bot.jobsChan),
+		"oldestJobAge":   oldest.Seconds(),
+		"chunksQueued":   len(bot.chunksChan),
+		"chunksCapacity": cap(bot.chunksChan),
+	}
+
+	bot.addMetric("job_metrics", tags, fields)
+
+	bot.DG.RLock()
+	heartbeatLatency := bot.DG.LastHeartbeatAck.Sub(bot.DG.LastHeartbeatSent)
+	bot.DG.RUnlock()
+
+	bot.metricsMutex.Lock()
+	rateLimitHits := bot.rateLimitHits
+	bot.metricsMutex.Unlock()
+
+	tags = map[string]string{"metric": "discord_connection", "server": "global"}
+	fields = map[string]interface{}{
+		"rateLimitHits": rateLimitHits,
+	}
+	// Negative while we wait for the ack of a heartbeat
+	if heartbeatLatency >= 0 {
+		fields["heartbeatLatency"] = heartbeatLatency.Seconds()
+	}
+
+	bot.addMetric("server_metrics", tags, fields)
+
+	dbStats := bot.DB.Stats()
+	tags = map[string]string{"metric": "db_pool", "server": "global"}
+	fields = map[string]interface{}{
+		"maxOpenConnections": dbStats.MaxOpenConnections,
+		"openConnections":    dbStats.OpenConnections,
+		"inUse":              dbStats.InUse,
+		"idle":               dbStats.Idle,
+		"waitCount":          dbStats.WaitCount,
+		"waitDuration":       dbStats.WaitDuration.Seconds(),
+		"maxIdleClosed":      dbStats.MaxIdleClosed,
+		"maxLifetimeClosed":  dbStats.MaxLifetimeClosed,
+	}
+
+	bot.addMetric("server_metrics", tags, fields)
+
+	if MyConfig.UseSshTunnel {
+		tags = map[string]string{"metric": "ssh_tunnel", "server": "global"}
+		fields = map[string]interface{}{
+			"activeConnections": tunnelConnections(),
+		}
+
+		bot.addMetric("server_metrics", tags, fields)
+	}
+
+	if bot.spool != nil {
+		stats := bot.spool.stats()
+		tags = map[string]string{"metric": "metrics_spool", "server": "global"}
+		fields = map[string]interface{}{
+			"depth":    stats.depth,
+			"bytes":    stats.bytes,
+			"dropped":  stats.dropped,
+			"replayed": stats.replayed,
+		}
+
+		bot.addMetric("server_metrics", tags, fields)
+	}
+
+	for guildID, size := range bot.members.counts() {
+		guild, err := bot.DG.State.Guild(guildID)
+		if err != nil {
+			continue
+		}
+
+		bot.guildPresencesMutex.Lock()
+		presences := len(bot.guildPresences[guildID])
+		bot.guildPresencesMutex.Unlock()
+
+		tags := map[string]string{"metric": "member_cache", "server": guild.Name}
+		fields := map[string]interface{}{
+			"members":   size,
+			"presences": presences,
+		}
+
+		bot.addMetric("server_metrics", tags, fields)
+	}
+}
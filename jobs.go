@@ -0,0 +1,924 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// Delay before the first retry, doubled for every further attempt
+	jobRetryBase = time.Second * 2
+	// Longest delay between two retries
+	jobRetryMax = time.Minute * 5
+	// Amount of failed jobs we remember
+	failedJobsLimit = 100
+	// Seconds clients should wait when the queue is full
+	jobRetryAfter = 30
+	// Delay after joining before we remind a member to link their account
+	linkCheckDelay = time.Hour
+	// Delay before an absorbed refresh runs on its own if its refreshAll
+	// never got to it, e.g. because the bot restarted
+	absorbedRefreshDelay = time.Hour
+)
+
+var errQueueFull = errors.New("Job queue is full")
+
+// botJob is a unit of work processed by the job queue
+type botJob interface {
+	// Type is used for logging and metrics
+	Type() string
+	// Guild is the discord guild the job runs on
+	Guild() string
+	// Timeout is the maximum time the job may run
+	Timeout() time.Duration
+	Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error
+}
+
+// serialJob is a job that must not run at the same time as other jobs
+// with the same key
+type serialJob interface {
+	botJob
+	SerialKey() string
+}
+
+// queuedJob wraps a job while it's waiting in the queue
+type queuedJob struct {
+	// ID of the stored job, 0 if it's not durable
+	id       int64
+	job      botJob
+	attempts int
+	queuedAt time.Time
+	// Done once the job is stored and was handed to the workers, merged
+	// requests wait for its ID and whether it made it into the queue
+	attempted sync.WaitGroup
+	queueErr  error
+}
+
+// failedJob is a job that ran out of retries or failed permanently
+type failedJob struct {
+	id       int64
+	job      botJob
+	attempts int
+	err      error
+	failedAt time.Time
+}
+
+// errPermanent marks errors that must not be retried
+type errPermanent struct {
+	err error
+}
+
+func (e errPermanent) Error() string {
+	return e.err.Error()
+}
+
+// refreshJob syncs roles and nickname of a single user
+type refreshJob struct {
+	guildID   string
+	discordID string
+}
+
+func (j refreshJob) Type() string           { return "refresh" }
+func (j refreshJob) Guild() string          { return j.guildID }
+func (j refreshJob) Timeout() time.Duration { return time.Minute }
+
+func (j refreshJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.refreshUser(ctx, j.discordID, guild, s)
+}
+
+// Only one refresh per user and guild at a time
+func (j refreshJob) SerialKey() string { return "refresh:" + j.guildID + ":" + j.discordID }
+
+// memberRolesJob assigns the roles of a single user again after a bulk
+// refresh failed for them
+type memberRolesJob struct {
+	guildID   string
+	discordID string
+}
+
+func (j memberRolesJob) Type() string           { return "memberRoles" }
+func (j memberRolesJob) Guild() string          { return j.guildID }
+func (j memberRolesJob) Timeout() time.Duration { return time.Minute }
+
+func (j memberRolesJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	slugs, err := bot.memberSlugs(ctx, j.discordID)
+	if err != nil {
+		return err
+	}
+
+	return bot.addMemberRoles(guild, j.discordID, slugs, s)
+}
+
+func (j memberRolesJob) SerialKey() string { return "refresh:" + j.guildID + ":" + j.discordID }
+
+// refreshAllJob syncs the roles of every linked user
+type refreshAllJob struct {
+	guildID string
+}
+
+func (j refreshAllJob) Type() string           { return "refreshAll" }
+func (j refreshAllJob) Guild() string          { return j.guildID }
+func (j refreshAllJob) Timeout() time.Duration { return time.Hour }
+
+func (j refreshAllJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.refreshAll(ctx, guild, s)
+}
+
+func (j refreshAllJob) SerialKey() string { return "guild:" + j.guildID }
+
+// refreshNicksJob syncs the nickname of every linked user
+type refreshNicksJob struct {
+	guildID string
+}
+
+func (j refreshNicksJob) Type() string           { return "refreshNicks" }
+func (j refreshNicksJob) Guild() string          { return j.guildID }
+func (j refreshNicksJob) Timeout() time.Duration { return time.Hour }
+
+func (j refreshNicksJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.refeshNicks(ctx, guild, s)
+}
+
+func (j refreshNicksJob) SerialKey() string { return "guild:" + j.guildID }
+
+// reconcileJob strips managed roles from unlinked members
+type reconcileJob struct {
+	guildID string
+}
+
+func (j reconcileJob) Type() string           { return "reconcile" }
+func (j reconcileJob) Guild() string          { return j.guildID }
+func (j reconcileJob) Timeout() time.Duration { return time.Minute * 30 }
+
+func (j reconcileJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.reconcileGuild(ctx, guild, s)
+}
+
+func (j reconcileJob) SerialKey() string { return "guild:" + j.guildID }
+
+// jobKey identifies jobs doing the same work, empty if the job can't be merged
+func jobKey(job botJob) string {
+	durable, ok := job.(durableJob)
+	if !ok {
+		return ""
+	}
+
+	return durable.Type() + ":" + durable.Guild() + ":" + durable.Payload()
+}
+
+// checkLinkJob reminds a new member to link their account
+type checkLinkJob struct {
+	guildID   string
+	discordID string
+}
+
+func (j checkLinkJob) Type() string           { return "checkLink" }
+func (j checkLinkJob) Guild() string          { return j.guildID }
+func (j checkLinkJob) Timeout() time.Duration { return time.Minute }
+
+func (j checkLinkJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	present, err := bot.memberPresent(guild.ID, j.discordID)
+	if err != nil || !present {
+		// Left the guild already, or we can't tell yet
+		return err
+	}
+
+	var id string
+	err = bot.GetIDByDiscordID.QueryRowContext(ctx, j.discordID).Scan(&id)
+	if err == sql.ErrNoRows {
+		bot.send(j.discordID, "Welcome to "+guild.Name+"! You did not link your discord on the homepage yet.\nHead to https://heroesawaken.com/profile/link/discord to link your Account and get your roles! :)", nil, guild, s)
+		return nil
+	}
+
+	return err
+}
+
+// memberPresent checks if a member is on a guild. The state misses offline
+// members of large guilds, so it asks the member cache and returns
+// errMembersLoading until the member list of the guild is complete.
+func (bot *AwakenBot) memberPresent(guildID string, discordID string) (bool, error) {
+	if bot.members.get(guildID, discordID) != nil {
+		return true, nil
+	}
+
+	if !bot.members.loadedGuilds()[guildID] {
+		return false, errMembersLoading
+	}
+
+	return false, nil
+}
+
+// memberJoinJob does the database work for a member that joined, the gateway
+// handler only updates the member cache
+type memberJoinJob struct {
+	guildID   string
+	discordID string
+	// When the member joined, the job might run a lot later
+	at time.Time
+}
+
+func (j memberJoinJob) Type() string           { return "memberJoin" }
+func (j memberJoinJob) Guild() string          { return j.guildID }
+func (j memberJoinJob) Timeout() time.Duration { return time.Minute }
+
+func (j memberJoinJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	bot.recordJoin(guild.ID, j.discordID, j.at)
+
+	if _, err := bot.enqueue(refreshJob{guildID: guild.ID, discordID: j.discordID}); err != nil {
+		log.Errorln("Could not refresh joining member", j.discordID, err.Error())
+	}
+
+	// Remind them later if they still did not link their account
+	bot.scheduleOnce(checkLinkJob{guildID: guild.ID, discordID: j.discordID}, time.Now().Add(linkCheckDelay))
+
+	return nil
+}
+
+// Joins and leaves of a member have to be stored in order
+func (j memberJoinJob) SerialKey() string { return "member:" + j.guildID + ":" + j.discordID }
+
+// memberLeaveJob does the database work for a member that left
+type memberLeaveJob struct {
+	guildID   string
+	discordID string
+	// When the member left
+	at time.Time
+}
+
+func (j memberLeaveJob) Type() string           { return "memberLeave" }
+func (j memberLeaveJob) Guild() string          { return j.guildID }
+func (j memberLeaveJob) Timeout() time.Duration { return time.Minute }
+
+func (j memberLeaveJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	bot.clearUnlinked(guild.ID, j.discordID)
+	bot.recordLeave(guild.ID, j.discordID, j.at)
+
+	return nil
+}
+
+func (j memberLeaveJob) SerialKey() string { return "member:" + j.guildID + ":" + j.discordID }
+
+// nickJob syncs the nickname of a single user
+type nickJob struct {
+	guildID   string
+	discordID string
+}
+
+func (j nickJob) Type() string           { return "nick" }
+func (j nickJob) Guild() string          { return j.guildID }
+func (j nickJob) Timeout() time.Duration { return time.Minute }
+
+func (j nickJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.syncNickByDiscordID(ctx, guild, j.discordID, s)
+}
+
+// removeRoleJob removes a temporary role
+type removeRoleJob struct {
+	guildID   string
+	discordID string
+	slug      string
+}
+
+func (j removeRoleJob) Type() string           { return "removeRole" }
+func (j removeRoleJob) Guild() string          { return j.guildID }
+func (j removeRoleJob) Timeout() time.Duration { return time.Minute }
+
+func (j removeRoleJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	roleID, ok := bot.rolesToIDMap[guild.ID][j.slug]
+	if !ok {
+		return errPermanent{errors.New("Unknown role " + j.slug)}
+	}
+
+	present, err := bot.memberPresent(guild.ID, j.discordID)
+	if err != nil || !present {
+		// Left the guild already, or we can't tell yet
+		return err
+	}
+
+	log.Noteln("Removing temporary role", j.slug, "from", j.discordID, "on", guild.Name)
+	return s.GuildMemberRoleRemove(guild.ID, j.discordID, roleID)
+}
+
+// retentionJob calculates the retention of new members
+type retentionJob struct {
+	guildID string
+}
+
+func (j retentionJob) Type() string           { return "retention" }
+func (j retentionJob) Guild() string          { return j.guildID }
+func (j retentionJob) Timeout() time.Duration { return time.Minute * 5 }
+
+func (j retentionJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	return bot.updateRetention(ctx, guild)
+}
+
+// digestJob posts the community digest to the staff channel
+type digestJob struct {
+	guildID string
+}
+
+func (j digestJob) Type() string           { return "digest" }
+func (j digestJob) Guild() string          { return j.guildID }
+func (j digestJob) Timeout() time.Duration { return time.Minute * 5 }
+
+func (j digestJob) Run(ctx context.Context, bot *AwakenBot, guild *discordgo.Guild, s *discordgo.Session) error {
+	// Disabled after it was scheduled
+	if !digestEnabled() {
+		return nil
+	}
+
+	// A failed post is retried on its own, the next digest is due anyway
+	bot.scheduleDigest(guild.ID, s)
+
+	return bot.postDigest(ctx, guild, s)
+}
+
+// serialKeys tracks the keys of running serial jobs. Jobs whose key is
+// taken wait here instead of blocking a worker, they get the key in the
+// order they arrived.
+type serialKeys struct {
+	mutex   sync.Mutex
+	waiting map[string][]*queuedJob
+	// Jobs the key was handed to while they were waiting
+	owners map[*queuedJob]string
+}
+
+func newSerialKeys() *serialKeys {
+	return &serialKeys{
+		waiting: make(map[string][]*queuedJob),
+		owners:  make(map[*queuedJob]string),
+	}
+}
+
+// acquire takes a key, false if it's taken. The job is then kept until the
+// key is handed to it.
+func (k *serialKeys) acquire(key string, queued *queuedJob) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.owners[queued] == key {
+		delete(k.owners, queued)
+		return true
+	}
+
+	if waiting, ok := k.waiting[key]; ok {
+		k.waiting[key] = append(waiting, queued)
+		return false
+	}
+
+	k.waiting[key] = nil
+	return true
+}
+
+// release hands a key to the job that waited longest and returns it, the key
+// is freed if nobody waits for it
+func (k *serialKeys) release(key string) *queuedJob {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	waiting := k.waiting[key]
+	if len(waiting) == 0 {
+		delete(k.waiting, key)
+		return nil
+	}
+
+	k.waiting[key] = waiting[1:]
+	k.owners[waiting[0]] = key
+	return waiting[0]
+}
+
+// disown takes a key back from a job that could not be queued
+func (k *serialKeys) disown(queued *queuedJob) {
+	k.mutex.Lock()
+	delete(k.owners, queued)
+	k.mutex.Unlock()
+}
+
+// enqueue adds a job to the queue, unless the same work is already queued.
+// It returns the queued job doing the work. It doesn't wait for the queue
+// and returns errQueueFull if there's no room left.
+func (bot *AwakenBot) enqueue(job botJob) (*queuedJob, error) {
+	key := jobKey(job)
+
+	queued := &queuedJob{
+		job:      job,
+		queuedAt: time.Now(),
+	}
+
+	// Only requests for the same job wait for it to be stored and queued,
+	// everything else keeps going while the database is slow.
+	queued.attempted.Add(1)
+
+	bot.jobsMutex.Lock()
+	if key != "" {
+		var absorbed *refreshJob
+		pending, ok := bot.pendingJobs[key]
+		if !ok && (job.Type() == "memberRoles" || job.Type() == "refresh") {
+			// A pending refreshAll assigns the roles of every user of that
+			// guild. Single refreshes also sync the nickname and tell the
+			// user, the refreshAll does that for the users it absorbed.
+			pending, ok = bot.pendingJobs[jobKey(refreshAllJob{guildID: job.Guild()})]
+			if refresh, isRefresh := job.(refreshJob); ok && isRefresh {
+				if bot.absorbedRefreshes[refresh.guildID] == nil {
+					bot.absorbedRefreshes[refresh.guildID] = make(map[string]int64)
+				}
+				if _, known := bot.absorbedRefreshes[refresh.guildID][refresh.discordID]; !known {
+					// The ID of its fallback is set once it's stored
+					bot.absorbedRefreshes[refresh.guildID][refresh.discordID] = 0
+					absorbed = &refresh
+				}
+			}
+		}
+
+		if ok {
+			bot.mergedJobs[job.Type()]++
+			bot.jobsMutex.Unlock()
+			log.Debugln("Merged job", key, "into a pending one")
+			if absorbed != nil {
+				bot.storeAbsorbed(*absorbed)
+			}
+			pending.attempted.Wait()
+			if pending.queueErr != nil {
+				return nil, pending.queueErr
+			}
+			return pending, nil
+		}
+
+		bot.pendingJobs[key] = queued
+	}
+	bot.jobsMutex.Unlock()
+
+	bot.storeJob(queued)
+
+	select {
+	case bot.jobsChan <- queued:
+		queued.attempted.Done()
+		return queued, nil
+	default:
+		bot.dequeue(queued)
+		bot.setJobState(queued, jobFailed, errQueueFull)
+		bot.dropJob(job.Type())
+		queued.queueErr = errQueueFull
+		queued.attempted.Done()
+		return nil, errQueueFull
+	}
+}
+
+// dropJob counts jobs we could not queue
+func (bot *AwakenBot) dropJob(jobType string) {
+	log.Errorln("Dropped job", jobType+":", errQueueFull.Error())
+
+	bot.jobsMutex.Lock()
+	bot.droppedJobs[jobType]++
+	bot.jobsMutex.Unlock()
+}
+
+// requeue adds a job that's already stored to the queue again
+func (bot *AwakenBot) requeue(queued *queuedJob) {
+	bot.jobsMutex.Lock()
+	queued.queuedAt = time.Now()
+	if key := jobKey(queued.job); key != "" {
+		if _, ok := bot.pendingJobs[key]; !ok {
+			bot.pendingJobs[key] = queued
+		}
+	}
+	bot.jobsMutex.Unlock()
+
+	bot.push(queued)
+}
+
+// push hands a job to the workers without waiting for room in the queue.
+// Stored jobs that don't fit wait in the database as retrying until
+// queueDueJobs picks them up again, the others are dropped. It returns false
+// if the job didn't fit.
+func (bot *AwakenBot) push(queued *queuedJob) bool {
+	select {
+	case bot.jobsChan <- queued:
+		return true
+	default:
+	}
+
+	bot.dequeue(queued)
+	if queued.id == 0 {
+		bot.dropJob(queued.job.Type())
+		return false
+	}
+
+	log.Noteln("Job queue is full, job", queued.id, "waits in the database")
+	bot.setRetrying(queued, time.Now().Add(time.Second*jobRetryAfter), errQueueFull)
+	return false
+}
+
+// enqueueAsync queues a job for handlers that must not wait for the
+// database. Jobs are stored and queued one after another in the order they
+// arrive, so events of the same member stay in order.
+func (bot *AwakenBot) enqueueAsync(job botJob) {
+	select {
+	case bot.gatewayJobs <- job:
+	default:
+		bot.dropJob(job.Type())
+	}
+}
+
+// processGatewayJobs queues the jobs of enqueueAsync
+func (bot *AwakenBot) processGatewayJobs() {
+	go func() {
+		for job := range bot.gatewayJobs {
+			if _, err := bot.enqueue(job); err != nil {
+				log.Errorln("Could not queue", job.Type(), "on", job.Guild(), err.Error())
+			}
+		}
+	}()
+}
+
+// dequeue marks a job as no longer pending, new requests for the same work
+// have to run again once it started
+func (bot *AwakenBot) dequeue(queued *queuedJob) {
+	key := jobKey(queued.job)
+	if key == "" {
+		return
+	}
+
+	bot.jobsMutex.Lock()
+	if bot.pendingJobs[key] == queued {
+		delete(bot.pendingJobs, key)
+	}
+	bot.jobsMutex.Unlock()
+}
+
+// processJobs starts the worker, it's only started once even if we
+// receive multiple ready events
+func (bot *AwakenBot) processJobs(s *discordgo.Session) {
+	bot.jobsOnce.Do(func() {
+		log.Noteln("Starting", MyConfig.JobWorkers, "job workers")
+
+		// Discordgo handles the rate limits for concurrent requests
+		for i := 0; i < MyConfig.JobWorkers; i++ {
+			go func() {
+				for queued := range bot.jobsChan {
+					log.Debugln(len(bot.jobsChan), "Jobs waiting to be processed")
+
+					bot.jobsMutex.Lock()
+					bot.busyWorkers++
+					bot.jobsMutex.Unlock()
+
+					bot.runJob(queued, s)
+
+					bot.jobsMutex.Lock()
+					bot.busyWorkers--
+					bot.jobsMutex.Unlock()
+				}
+			}()
+		}
+	})
+}
+
+// runJob runs a single job and retries or fails it on errors
+func (bot *AwakenBot) runJob(queued *queuedJob, s *discordgo.Session) {
+	job := queued.job
+
+	if serial, ok := job.(serialJob); ok {
+		if !bot.serialJobs.acquire(serial.SerialKey(), queued) {
+			log.Debugln("Job", job.Type(), "waits for", serial.SerialKey())
+			return
+		}
+
+		defer func() {
+			// Still pending, so it goes back to the queue as it is. If there's
+			// no room the key goes to the next one.
+			for next := bot.serialJobs.release(serial.SerialKey()); next != nil; next = bot.serialJobs.release(serial.SerialKey()) {
+				if bot.push(next) {
+					break
+				}
+				bot.serialJobs.disown(next)
+			}
+		}()
+	}
+
+	bot.jobsMutex.Lock()
+	queued.attempts++
+	bot.jobsMutex.Unlock()
+	bot.dequeue(queued)
+
+	started := time.Now()
+	bot.jobsMutex.Lock()
+	bot.runningJobs[queued] = started
+	bot.jobsMutex.Unlock()
+
+	defer func() {
+		bot.jobsMutex.Lock()
+		delete(bot.runningJobs, queued)
+		bot.jobsMutex.Unlock()
+	}()
+
+	guild, err := s.State.Guild(job.Guild())
+	if err != nil {
+		if _, ok := job.(refreshAllJob); ok {
+			bot.releaseAbsorbed(job.Guild(), bot.takeAbsorbedRefreshes(job.Guild()))
+		}
+		bot.failJob(queued, errPermanent{errors.New("Unknown guild " + job.Guild())})
+		bot.recordJob(queued, "", outcomeInternal, started)
+		return
+	}
+
+	bot.updatePresences(guild)
+	bot.setJobState(queued, jobRunning, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout())
+	err = job.Run(ctx, bot, guild, s)
+	cancel()
+
+	if err == nil {
+		bot.setJobState(queued, jobSucceeded, nil)
+		bot.recordJob(queued, guild.Name, outcomeSuccess, started)
+		return
+	}
+
+	// Waiting for the member list after a restart can take longer than all
+	// retries, it doesn't use them up
+	loading := err == errMembersLoading
+	if loading {
+		bot.jobsMutex.Lock()
+		queued.attempts--
+		bot.jobsMutex.Unlock()
+	}
+
+	if !isRetryable(err) || queued.attempts > MyConfig.JobMaxRetries {
+		bot.failJob(queued, err)
+		bot.recordJob(queued, guild.Name, outcomeInternal, started)
+		return
+	}
+
+	bot.recordJob(queued, guild.Name, outcomeRetry, started)
+
+	backoff := time.Second * jobRetryAfter
+	if !loading {
+		backoff = jobRetryBase << uint(queued.attempts-1)
+	}
+	if backoff > jobRetryMax || backoff <= 0 {
+		backoff = jobRetryMax
+	}
+
+	log.Noteln("Job", job.Type(), "on", job.Guild(), "failed, retrying in", backoff.String()+":", err.Error())
+
+	stored := bot.setRetrying(queued, time.Now().Add(backoff), err) == nil
+	time.AfterFunc(backoff, func() {
+		// queueDueJobs might have picked it up already
+		if stored && queued.id != 0 && !bot.claimJob(queued.id, jobRetrying) {
+			return
+		}
+		bot.requeue(queued)
+	})
+}
+
+// failJob remembers a job that can't be processed
+func (bot *AwakenBot) failJob(queued *queuedJob, err error) {
+	log.Errorln("Job", queued.job.Type(), "on", queued.job.Guild(), "failed after", queued.attempts, "attempts:", err.Error())
+	bot.setJobState(queued, jobFailed, err)
+
+	bot.failedJobsMutex.Lock()
+	bot.failedJobs = append(bot.failedJobs, failedJob{
+		id:       queued.id,
+		job:      queued.job,
+		attempts: queued.attempts,
+		err:      err,
+		failedAt: time.Now(),
+	})
+	if len(bot.failedJobs) > failedJobsLimit {
+		bot.failedJobs = bot.failedJobs[len(bot.failedJobs)-failedJobsLimit:]
+	}
+	bot.failedJobsMutex.Unlock()
+}
+
+// isRetryable checks if an error might go away by trying again
+func isRetryable(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn || err == errMembersLoading {
+		return true
+	}
+
+	switch e := err.(type) {
+	case errPermanent:
+		return false
+	case *discordgo.RESTError:
+		if e.Response == nil {
+			return false
+		}
+		return e.Response.StatusCode == 429 || e.Response.StatusCode >= 500
+	case net.Error:
+		return true
+	}
+
+	// Connection loss of the mysql driver is not typed
+	return strings.Contains(err.Error(), "connection refused") ||
+		strings.Contains(err.Error(), "broken pipe")
+}
+
+// updatePresences copies the current presences of a guild
+func (bot *AwakenBot) updatePresences(guild *discordgo.Guild) {
+	bot.guildPresencesMutex.Lock()
+	bot.guildPresences[guild.ID] = make(map[string]*discordgo.Presence)
+	for index := range guild.Presences {
+		bot.guildPresences[guild.ID][guild.Presences[index].User.ID] = guild.Presences[index]
+	}
+	bot.guildPresencesMutex.Unlock()
+}
+
+// processChunks fills the member cache. Chunks don't go through the job
+// queue, so they can't be starved by long running jobs.
+func (bot *AwakenBot) processChunks(s *discordgo.Session) {
+	go func() {
+		for chunk := range bot.chunksChan {
+			guild, err := s.State.Guild(chunk.GuildID)
+			if err != nil {
+				log.Errorln("Got members of unknown guild", chunk.GuildID)
+				continue
+			}
+
+			bot.updatePresences(guild)
+
+			log.Noteln("Adding " + strconv.Itoa(len(chunk.Members)) + " members, chunk " + strconv.Itoa(chunk.ChunkIndex+1) + "/" + strconv.Itoa(chunk.ChunkCount))
+			drift := bot.members.addChunk(chunk)
+			if drift == nil {
+				continue
+			}
+
+			log.Noteln("Total Members:", bot.members.count(guild.ID))
+			if drift.corrected() > 0 {
+				log.Noteln("Member resync of", guild.Name, "corrected", drift.corrected(), "entries:", drift.added, "added,", drift.removed, "removed,", drift.updated, "updated")
+			}
+
+			tags := map[string]string{"metric": "member_resync", "server": guild.Name}
+			fields := map[string]interface{}{
+				"added":     drift.added,
+				"removed":   drift.removed,
+				"updated":   drift.updated,
+				"corrected": drift.corrected(),
+			}
+
+			bot.addMetric("discord_metrics", tags, fields)
+		}
+	}()
+}
+
+// refreshAll assigns the website roles of every linked user
+func (bot *AwakenBot) refreshAll(ctx context.Context, guild *discordgo.Guild, s *discordgo.Session) (err error) {
+	absorbed := bot.takeAbsorbedRefreshes(guild.ID)
+	defer func() {
+		if err != nil {
+			// Don't lose the single refreshes, they run on their own
+			bot.releaseAbsorbed(guild.ID, absorbed)
+		}
+	}()
+
+	rows, err := bot.GetAllLinkedUsers.QueryContext(ctx)
+	if err != nil {
+		log.Errorln("Error getting all users.")
+		return err
+	}
+	defer rows.Close()
+
+	count := 0
+	retried := 0
+	for rows.Next() {
+		if ctx.Err() != nil {
+			return errPermanent{ctx.Err()}
+		}
+
+		var discordID, slugs string
+
+		err := rows.Scan(&discordID, &slugs)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		if id, ok := absorbed[discordID]; ok {
+			delete(absorbed, discordID)
+			if bot.claimAbsorbed(id) {
+				bot.refreshAbsorbed(ctx, guild, discordID, s)
+				count++
+				continue
+			}
+		}
+
+		// Single members failing is expected, e.g. when they left the guild.
+		// Only retry the members that failed, not everybody.
+		err = bot.addMemberRoles(guild, discordID, strings.Split(slugs, ","), s)
+		if err != nil && isRetryable(err) {
+			if _, err := bot.enqueue(memberRolesJob{guildID: guild.ID, discordID: discordID}); err != nil {
+				log.Errorln("Could not retry roles of", discordID, err.Error())
+			}
+			retried++
+		}
+
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Users that are not linked anymore still get told and marked
+	for discordID, id := range absorbed {
+		delete(absorbed, discordID)
+		if bot.claimAbsorbed(id) {
+			bot.refreshAbsorbed(ctx, guild, discordID, s)
+		}
+	}
+
+	log.Noteln("Updated " + strconv.Itoa(count) + " users, " + strconv.Itoa(retried) + " retried.")
+
+	return nil
+}
+
+// takeAbsorbedRefreshes returns the users whose single refresh was merged
+// into the pending refreshAll of a guild, with the IDs of their fallbacks
+func (bot *AwakenBot) takeAbsorbedRefreshes(guildID string) map[string]int64 {
+	bot.jobsMutex.Lock()
+	defer bot.jobsMutex.Unlock()
+
+	absorbed := bot.absorbedRefreshes[guildID]
+	delete(bot.absorbedRefreshes, guildID)
+	if absorbed == nil {
+		absorbed = make(map[string]int64)
+	}
+
+	return absorbed
+}
+
+// storeAbsorbed schedules a fallback for a refresh absorbed by a refreshAll.
+// The refreshAll cancels it once it did the refresh, otherwise it runs on its
+// own, e.g. if the bot restarted before the refreshAll got to it.
+func (bot *AwakenBot) storeAbsorbed(job refreshJob) {
+	id, err := bot.schedule(job, time.Now().Add(absorbedRefreshDelay))
+	if err != nil {
+		// The refreshAll still does it, it's just lost on restart
+		return
+	}
+
+	bot.jobsMutex.Lock()
+	_, waiting := bot.absorbedRefreshes[job.guildID][job.discordID]
+	if waiting {
+		bot.absorbedRefreshes[job.guildID][job.discordID] = id
+	}
+	bot.jobsMutex.Unlock()
+
+	// The refreshAll took it before the fallback was stored
+	if !waiting {
+		bot.claimAbsorbed(id)
+	}
+}
+
+// claimAbsorbed cancels the fallback of an absorbed refresh, so the
+// refreshAll can do it. It returns false if the fallback runs already.
+func (bot *AwakenBot) claimAbsorbed(id int64) bool {
+	if id == 0 {
+		return true
+	}
+
+	cancelled, err := bot.cancelJob(id)
+	if err != nil {
+		log.Errorln("Could not cancel absorbed refresh", id, err.Error())
+	}
+
+	return cancelled
+}
+
+// releaseAbsorbed queues the absorbed refreshes a refreshAll did not get to.
+// Stored fallbacks are queued as they are, so they are not lost either.
+func (bot *AwakenBot) releaseAbsorbed(guildID string, absorbed map[string]int64) {
+	for discordID, id := range absorbed {
+		job := refreshJob{guildID: guildID, discordID: discordID}
+		if id == 0 {
+			if _, err := bot.enqueue(job); err != nil {
+				log.Errorln("Could not refresh", discordID, err.Error())
+			}
+			continue
+		}
+
+		if bot.claimJob(id, jobScheduled) {
+			bot.requeue(&queuedJob{id: id, job: job, queuedAt: time.Now()})
+		}
+	}
+}
+
+// refreshAbsorbed does the full refresh of a user for a refreshAll. Retryable
+// failures go to a refresh job of their own, which tells the user at the end.
+func (bot *AwakenBot) refreshAbsorbed(ctx context.Context, guild *discordgo.Guild, discordID string, s *discordgo.Session) {
+	err := bot.refreshUser(ctx, discordID, guild, s)
+	if err != nil && isRetryable(err) {
+		if _, err := bot.enqueue(refreshJob{guildID: guild.ID, discordID: discordID}); err != nil {
+			log.Errorln("Could not retry refresh of", discordID, err.Error())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestIsRetryable(t *testing.T) {
+	restError := func(status int) error {
+		return &discordgo.RESTError{Response: &http.Response{StatusCode: status}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad connection", driver.ErrBadConn, true},
+		{"invalid mysql connection", mysql.ErrInvalidConn, true},
+		{"members loading", errMembersLoading, true},
+		{"rate limited", restError(429), true},
+		{"discord down", restError(502), true},
+		{"missing permissions", restError(403), false},
+		{"unknown member", restError(404), false},
+		{"rest error without response", &discordgo.RESTError{}, false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("timeout")}, true},
+		{"connection refused", errors.New("dial tcp: connection refused"), true},
+		{"broken pipe", errors.New("write: broken pipe"), true},
+		{"permanent", errPermanent{driver.ErrBadConn}, false},
+		{"not linked", errNotLinked, false},
+		{"other", errors.New("something else"), false},
+	}
+
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("isRetryable(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSerialKeysOrder(t *testing.T) {
+	keys := newSerialKeys()
+	running, join, leave := &queuedJob{}, &queuedJob{}, &queuedJob{}
+
+	if !keys.acquire("member", running) {
+		t.Fatal("free key was not acquired")
+	}
+	if keys.acquire("member", join) || keys.acquire("member", leave) {
+		t.Fatal("taken key was acquired")
+	}
+
+	// The key goes to the waiting jobs in order and stays taken meanwhile
+	if next := keys.release("member"); next != join {
+		t.Fatal("key was not handed to the first waiting job")
+	}
+	if keys.acquire("member", &queuedJob{}) {
+		t.Fatal("handed key was acquired by another job")
+	}
+	if !keys.acquire("member", join) {
+		t.Fatal("handed key was not acquired by its owner")
+	}
+
+	if next := keys.release("member"); next != leave {
+		t.Fatal("key was not handed to the second waiting job")
+	}
+	if !keys.acquire("member", leave) {
+		t.Fatal("handed key was not acquired by its owner")
+	}
+}
+
+func TestEventPayload(t *testing.T) {
+	at := time.Unix(1500000000, 42)
+
+	discordID, got := splitEventPayload(eventPayload("1234", at))
+	if discordID != "1234" || !got.Equal(at) {
+		t.Errorf("splitEventPayload = %q, %v, want %q, %v", discordID, got, "1234", at)
+	}
+}
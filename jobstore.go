@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// States of a stored job
+const (
+	jobScheduled = "scheduled"
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	// Failed, waiting for the next try
+	jobRetrying  = "retrying"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const (
+	// Finished jobs are kept that long before they're cleaned up
+	jobRetention = time.Hour * 24 * 7
+	// How often we look for scheduled jobs that are due
+	jobScheduleInterval = time.Second * 30
+	// How often finished jobs are cleaned up
+	jobPurgeInterval = time.Hour
+)
+
+var errNotDurable = errors.New("Only durable jobs can be scheduled")
+
+// durableJob is a job that's stored in the database until it's done,
+// so it survives restarts. Jobs may run more than once if the bot dies
+// while running them, so Run has to be idempotent.
+type durableJob interface {
+	botJob
+	// Payload is everything but the guild needed to recreate the job
+	Payload() string
+}
+
+// jobDecoders recreates stored jobs by their type
+var jobDecoders = map[string]func(guildID string, payload string) botJob{
+	"refresh": func(guildID string, payload string) botJob {
+		return refreshJob{guildID: guildID, discordID: payload}
+	},
+	"memberRoles": func(guildID string, payload string) botJob {
+		return memberRolesJob{guildID: guildID, discordID: payload}
+	},
+	"refreshAll": func(guildID string, payload string) botJob {
+		return refreshAllJob{guildID: guildID}
+	},
+	"refreshNicks": func(guildID string, payload string) botJob {
+		return refreshNicksJob{guildID: guildID}
+	},
+	"reconcile": func(guildID string, payload string) botJob {
+		return reconcileJob{guildID: guildID}
+	},
+	"checkLink": func(guildID string, payload string) botJob {
+		return checkLinkJob{guildID: guildID, discordID: payload}
+	},
+	"nick": func(guildID string, payload string) botJob {
+		return nickJob{guildID: guildID, discordID: payload}
+	},
+	"retention": func(guildID string, payload string) botJob {
+		return retentionJob{guildID: guildID}
+	},
+	"digest": func(guildID string, payload string) botJob {
+		return digestJob{guildID: guildID}
+	},
+	"memberJoin": func(guildID string, payload string) botJob {
+		discordID, at := splitEventPayload(payload)
+		return memberJoinJob{guildID: guildID, discordID: discordID, at: at}
+	},
+	"memberLeave": func(guildID string, payload string) botJob {
+		discordID, at := splitEventPayload(payload)
+		return memberLeaveJob{guildID: guildID, discordID: discordID, at: at}
+	},
+	"removeRole": func(guildID string, payload string) botJob {
+		parts := strings.SplitN(payload, ":", 2)
+		if len(parts) != 2 {
+			return removeRoleJob{guildID: guildID, discordID: payload}
+		}
+		return removeRoleJob{guildID: guildID, discordID: parts[0], slug: parts[1]}
+	},
+}
+
+func (j refreshJob) Payload() string      { return j.discordID }
+func (j memberRolesJob) Payload() string  { return j.discordID }
+func (j refreshAllJob) Payload() string   { return "" }
+func (j refreshNicksJob) Payload() string { return "" }
+func (j reconcileJob) Payload() string    { return "" }
+func (j checkLinkJob) Payload() string    { return j.discordID }
+func (j nickJob) Payload() string         { return j.discordID }
+func (j removeRoleJob) Payload() string   { return j.discordID + ":" + j.slug }
+func (j retentionJob) Payload() string    { return "" }
+func (j digestJob) Payload() string       { return "" }
+func (j memberJoinJob) Payload() string   { return eventPayload(j.discordID, j.at) }
+func (j memberLeaveJob) Payload() string  { return eventPayload(j.discordID, j.at) }
+
+// eventPayload stores a member event with its time, so events of the same
+// member are not merged
+func eventPayload(discordID string, at time.Time) string {
+	return discordID + ":" + strconv.FormatInt(at.UnixNano(), 10)
+}
+
+func splitEventPayload(payload string) (string, time.Time) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		return payload, time.Now()
+	}
+
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return parts[0], time.Now()
+	}
+
+	return parts[0], time.Unix(0, nanos)
+}
+
+// storeJob writes a new durable job to the database and remembers its ID
+func (bot *AwakenBot) storeJob(queued *queuedJob) {
+	job, ok := queued.job.(durableJob)
+	if !ok {
+		return
+	}
+
+	res, err := bot.InsertJob.Exec(job.Type(), job.Guild(), job.Payload(), jobQueued, queued.queuedAt.Unix(), queued.queuedAt.Unix())
+	if err != nil {
+		// Still process it, it's just lost on restart
+		log.Errorln("Could not store job", job.Type(), err.Error())
+		return
+	}
+
+	queued.id, err = res.LastInsertId()
+	if err != nil {
+		log.Errorln("Could not get ID of stored job", job.Type(), err.Error())
+	}
+}
+
+// setJobState updates a stored job
+func (bot *AwakenBot) setJobState(queued *queuedJob, state string, jobErr error) {
+	if queued.id == 0 {
+		return
+	}
+
+	lastError := ""
+	if jobErr != nil {
+		lastError = jobErr.Error()
+	}
+
+	now := time.Now().Unix()
+	var startedAt, finishedAt interface{}
+	switch state {
+	case jobRunning:
+		startedAt = now
+	case jobSucceeded, jobFailed:
+		finishedAt = now
+	}
+
+	_, err := bot.UpdateJobState.Exec(state, queued.attempts, lastError, startedAt, finishedAt, queued.id)
+	if err != nil {
+		log.Errorln("Could not update job", queued.id, "to", state, err.Error())
+	}
+}
+
+// resumeJobs queues all jobs that were not finished before the last shutdown.
+// Retries are left to queueDueJobs, they wait until they are due.
+func (bot *AwakenBot) resumeJobs() {
+	bot.purgeJobs()
+
+	rows, err := bot.GetUnfinishedJobs.Query()
+	if err != nil {
+		log.Errorln("Could not get unfinished jobs", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var resumed []*queuedJob
+	for rows.Next() {
+		var id, createdAt int64
+		var attempts int
+		var jobType, guildID, payload string
+
+		err := rows.Scan(&id, &jobType, &guildID, &payload, &attempts, &createdAt)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		decode, ok := jobDecoders[jobType]
+		if !ok {
+			log.Errorln("Unknown stored job type", jobType)
+			continue
+		}
+
+		resumed = append(resumed, &queuedJob{
+			id:       id,
+			job:      decode(guildID, payload),
+			attempts: attempts,
+			queuedAt: time.Unix(createdAt, 0),
+		})
+	}
+
+	log.Noteln("Resuming", len(resumed), "unfinished jobs")
+
+	// Mark them as pending right away, so new requests get merged
+	bot.jobsMutex.Lock()
+	for _, queued := range resumed {
+		bot.pendingJobs[jobKey(queued.job)] = queued
+	}
+	bot.jobsMutex.Unlock()
+
+	// Jobs that don't fit into the queue wait in the database
+	for _, queued := range resumed {
+		bot.push(queued)
+	}
+}
+
+// schedule stores a job that's queued once runAt is reached
+func (bot *AwakenBot) schedule(job botJob, runAt time.Time) (int64, error) {
+	durable, ok := job.(durableJob)
+	if !ok {
+		return 0, errNotDurable
+	}
+
+	res, err := bot.InsertJob.Exec(durable.Type(), durable.Guild(), durable.Payload(), jobScheduled, time.Now().Unix(), runAt.Unix())
+	if err != nil {
+		log.Errorln("Could not schedule job", durable.Type(), err.Error())
+		return 0, err
+	}
+
+	log.Debugln("Scheduled job", durable.Type(), "on", durable.Guild(), "for", runAt.String())
+	return res.LastInsertId()
+}
+
+// scheduleOnce schedules a job unless the same job is already waiting to run.
+// It returns 0 if it was not scheduled again.
+func (bot *AwakenBot) scheduleOnce(job botJob, runAt time.Time) (int64, error) {
+	durable, ok := job.(durableJob)
+	if !ok {
+		return 0, errNotDurable
+	}
+
+	var count int
+	err := bot.CountPendingJobs.QueryRow(durable.Type(), durable.Guild(), durable.Payload()).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	if count > 0 {
+		log.Debugln("Job", durable.Type(), "on", durable.Guild(), "is already waiting")
+		return 0, nil
+	}
+
+	return bot.schedule(job, runAt)
+}
+
+// setRetrying marks a stored job as waiting for its next try at runAt.
+// queueDueJobs picks it up once it's due, unless the retry timed in memory
+// claims it first.
+func (bot *AwakenBot) setRetrying(queued *queuedJob, runAt time.Time, jobErr error) error {
+	if queued.id == 0 {
+		return nil
+	}
+
+	_, err := bot.RescheduleJob.Exec(jobRetrying, queued.attempts, jobErr.Error(), runAt.Unix(), queued.id)
+	if err != nil {
+		log.Errorln("Could not update job", queued.id, "to", jobRetrying, err.Error())
+	}
+
+	return err
+}
+
+// cancelJob cancels a scheduled job, it returns false if there's no such job
+func (bot *AwakenBot) cancelJob(id int64) (bool, error) {
+	res, err := bot.CancelJob.Exec(jobCancelled, time.Now().Unix(), id, jobScheduled)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+// purgeJobs deletes finished jobs older than the retention
+func (bot *AwakenBot) purgeJobs() {
+	_, err := bot.DeleteOldJobs.Exec(time.Now().Add(-jobRetention).Unix())
+	if err != nil {
+		log.Errorln("Could not clean up old jobs", err.Error())
+	}
+}
+
+// processScheduledJobs queues scheduled jobs once they are due and cleans
+// up finished ones
+func (bot *AwakenBot) processScheduledJobs() {
+	ticker := time.NewTicker(jobScheduleInterval)
+	purgeTicker := time.NewTicker(jobPurgeInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				bot.queueDueJobs()
+			case <-purgeTicker.C:
+				bot.purgeJobs()
+			}
+		}
+	}()
+}
+
+func (bot *AwakenBot) queueDueJobs() {
+	rows, err := bot.GetDueJobs.Query(jobScheduled, jobRetrying, time.Now().Unix())
+	if err != nil {
+		log.Errorln("Could not get due jobs", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var due []*queuedJob
+	// Scheduled jobs and retries that were not queued in memory
+	states := make(map[*queuedJob]string)
+	for rows.Next() {
+		var id, createdAt int64
+		var attempts int
+		var jobType, guildID, payload, state string
+
+		err := rows.Scan(&id, &jobType, &guildID, &payload, &state, &attempts, &createdAt)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		decode, ok := jobDecoders[jobType]
+		if !ok {
+			log.Errorln("Unknown stored job type", jobType)
+			continue
+		}
+
+		queued := &queuedJob{
+			id:       id,
+			job:      decode(guildID, payload),
+			attempts: attempts,
+			queuedAt: time.Now(),
+		}
+		due = append(due, queued)
+		states[queued] = state
+	}
+
+	for _, queued := range due {
+		// Somebody might have cancelled or queued it in the meantime
+		if bot.claimJob(queued.id, states[queued]) {
+			bot.requeue(queued)
+		}
+	}
+}
+
+// claimJob marks a stored job as queued if it's still in the given state,
+// false if somebody else changed it in the meantime
+func (bot *AwakenBot) claimJob(id int64, state string) bool {
+	res, err := bot.ClaimJob.Exec(jobQueued, id, state)
+	if err != nil {
+		log.Errorln("Could not queue", state, "job", id, err.Error())
+		return false
+	}
+
+	affected, _ := res.RowsAffected()
+	return affected == 1
+}
@@ -16,10 +16,23 @@ import (
 func init() {
 	flag.StringVar(&configPath, "config", "config.yml", "Path to yml configuration file")
 	flag.StringVar(&logLevel, "logLevel", "error", "LogLevel [error|warning|note|debug]")
+}
+
+// loadConfig parses the flags and the config file. It's not done in init,
+// so tests don't need a config.
+func loadConfig() {
 	flag.Parse()
 
 	log.SetLevel(logLevel)
 	MyConfig.Load(configPath)
+
+	if MyConfig.JobWorkers < 1 {
+		MyConfig.JobWorkers = 1
+	}
+
+	if MyConfig.ReconcileMinutes < 1 {
+		MyConfig.ReconcileMinutes = 1
+	}
 }
 
 var (
@@ -33,6 +46,18 @@ var (
 		MysqlUser:   "",
 		MysqlDb:     "",
 		MysqlPw:     "",
+
+		UnlinkedGraceHours:   48,
+		ReconcileMinutes:     60,
+		MemberResyncMinutes:  60,
+		NickTemplate:         "{username}",
+		JobMaxRetries:        5,
+		JobWorkers:           4,
+		MetricsBackend:       metricsInflux,
+		OwnGame:              "Battlefield Heroes",
+		MetricsSpoolMaxMB:    50,
+		MetricsSpoolMaxHours: 24,
+		DigestHour:           9,
 	}
 
 	Version = "0.0.1"
@@ -41,17 +66,15 @@ var (
 )
 
 func main() {
+	loadConfig()
+
 	var err error
 	if MyConfig.DiscordToken == "" {
 		log.Errorln("No token provided. Please run: airhorn -t <bot token>")
 		return
 	}
 
-	metricConnection := new(core.InfluxDB)
-	err = metricConnection.New(MyConfig.InfluxDBHost, MyConfig.InfluxDBDatabase, MyConfig.InfluxDBUser, MyConfig.InfluxDBPassword, AppName, Version)
-	if err != nil {
-		log.Fatalln("Error connecting to MetricsDB:", err)
-	}
+	metrics, prometheus, spool := newMetricsSink()
 
 	if MyConfig.UseSshTunnel {
 		startRemoveCon(MyConfig.SshAddr, MyConfig.LocalAddr, MyConfig.RemoteAddr)
@@ -76,7 +99,7 @@ func main() {
 		return
 	}
 
-	bot := NewAwakenBot(dbSQL, dg, metricConnection, "!ha")
+	bot := NewAwakenBot(dbSQL, dg, metrics, prometheus, spool, "!ha")
 
 	// Open the websocket and begin listening.
 	err = bot.DG.Open()
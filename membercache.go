@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+)
+
+// errMembersLoading is returned while the member list of a guild isn't complete
+var errMembersLoading = errors.New("Member list is still loading")
+
+// memberChunk is a GUILD_MEMBERS_CHUNK event. Our discordgo version doesn't
+// decode the chunk index and count, so we read them from the raw event.
+type memberChunk struct {
+	GuildID    string              `json:"guild_id"`
+	Members    []*discordgo.Member `json:"members"`
+	ChunkIndex int                 `json:"chunk_index"`
+	ChunkCount int                 `json:"chunk_count"`
+}
+
+// memberLoad is a full member list that's still being received
+type memberLoad struct {
+	members  map[string]*discordgo.Member
+	received map[int]bool
+	// Members changed by events during the load, their chunk data is older
+	touched map[string]bool
+}
+
+// memberDrift counts cache entries a full reload had to correct, i.e.
+// events we missed
+type memberDrift struct {
+	added   int
+	removed int
+	updated int
+}
+
+func (drift *memberDrift) corrected() int {
+	return drift.added + drift.removed + drift.updated
+}
+
+// memberCache holds the members of every guild. A full member list is
+// collected in the background and swapped in once all chunks arrived.
+type memberCache struct {
+	mutex   sync.RWMutex
+	members map[string]map[string]*discordgo.Member
+	loaded  map[string]bool
+	loading map[string]*memberLoad
+}
+
+func newMemberCache() *memberCache {
+	return &memberCache{
+		members: make(map[string]map[string]*discordgo.Member),
+		loaded:  make(map[string]bool),
+		loading: make(map[string]*memberLoad),
+	}
+}
+
+// reset forgets all members of a guild
+func (cache *memberCache) reset(guildID string) {
+	cache.mutex.Lock()
+	cache.members[guildID] = make(map[string]*discordgo.Member)
+	cache.loaded[guildID] = false
+	delete(cache.loading, guildID)
+	cache.mutex.Unlock()
+}
+
+// startLoad begins collecting a new full member list of a guild
+func (cache *memberCache) startLoad(guildID string) {
+	cache.mutex.Lock()
+	cache.loading[guildID] = &memberLoad{
+		members:  make(map[string]*discordgo.Member),
+		received: make(map[int]bool),
+		touched:  make(map[string]bool),
+	}
+	cache.mutex.Unlock()
+}
+
+// addChunk adds a chunk to the member list that's being loaded. Once all
+// chunks arrived the list replaces the cached members and the drift to the
+// old list is returned, nil until then.
+func (cache *memberCache) addChunk(chunk *memberChunk) *memberDrift {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	load, ok := cache.loading[chunk.GuildID]
+	if !ok {
+		// Requested by somebody else, or the guild was reset meanwhile
+		log.Noteln("Got unexpected member chunk for", chunk.GuildID)
+		return nil
+	}
+
+	for _, member := range chunk.Members {
+		if load.touched[member.User.ID] {
+			continue
+		}
+		load.members[member.User.ID] = member
+	}
+	load.received[chunk.ChunkIndex] = true
+
+	if chunk.ChunkCount == 0 {
+		// Without the count we can't tell when the list is complete
+		log.Errorln("Got member chunk without chunk count for", chunk.GuildID)
+		return nil
+	}
+
+	if len(load.received) < chunk.ChunkCount {
+		return nil
+	}
+
+	drift := new(memberDrift)
+	if cache.loaded[chunk.GuildID] {
+		drift = diffMembers(cache.members[chunk.GuildID], load.members)
+	}
+
+	cache.members[chunk.GuildID] = load.members
+	cache.loaded[chunk.GuildID] = true
+	delete(cache.loading, chunk.GuildID)
+
+	return drift
+}
+
+// diffMembers counts the differences between the cached and the loaded members
+func diffMembers(cached map[string]*discordgo.Member, loaded map[string]*discordgo.Member) *memberDrift {
+	drift := new(memberDrift)
+
+	for discordID, member := range loaded {
+		old, ok := cached[discordID]
+		if !ok {
+			drift.added++
+			continue
+		}
+
+		if !sameMember(old, member) {
+			drift.updated++
+		}
+	}
+
+	for discordID := range cached {
+		if _, ok := loaded[discordID]; !ok {
+			drift.removed++
+		}
+	}
+
+	return drift
+}
+
+// sameMember compares the parts of a member we use
+func sameMember(a *discordgo.Member, b *discordgo.Member) bool {
+	if a.Nick != b.Nick || a.User.Username != b.User.Username || len(a.Roles) != len(b.Roles) {
+		return false
+	}
+
+	roles := make(map[string]bool)
+	for _, role := range a.Roles {
+		roles[role] = true
+	}
+	for _, role := range b.Roles {
+		if !roles[role] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// set adds or updates a member
+func (cache *memberCache) set(guildID string, member *discordgo.Member) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.members[guildID] == nil {
+		cache.members[guildID] = make(map[string]*discordgo.Member)
+	}
+	cache.members[guildID][member.User.ID] = member
+
+	// Don't let the running load overwrite this with an older state
+	if load, ok := cache.loading[guildID]; ok {
+		load.members[member.User.ID] = member
+		load.touched[member.User.ID] = true
+	}
+}
+
+// remove forgets a member
+func (cache *memberCache) remove(guildID string, discordID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.members[guildID], discordID)
+	if load, ok := cache.loading[guildID]; ok {
+		delete(load.members, discordID)
+		load.touched[discordID] = true
+	}
+}
+
+// get returns a member, nil if it's not cached
+func (cache *memberCache) get(guildID string, discordID string) *discordgo.Member {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	return cache.members[guildID][discordID]
+}
+
+// hasGuild checks if we know the members of a guild
+func (cache *memberCache) hasGuild(guildID string) bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	_, ok := cache.members[guildID]
+	return ok
+}
+
+// count returns the amount of cached members of a guild
+func (cache *memberCache) count(guildID string) int {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	return len(cache.members[guildID])
+}
+
+// counts returns the amount of cached members of every guild
+func (cache *memberCache) counts() map[string]int {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for guildID, members := range cache.members {
+		counts[guildID] = len(members)
+	}
+
+	return counts
+}
+
+// loadedGuilds returns whether the full member list of every guild arrived
+func (cache *memberCache) loadedGuilds() map[string]bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	loaded := make(map[string]bool)
+	for guildID, ok := range cache.loaded {
+		loaded[guildID] = ok
+	}
+
+	return loaded
+}
+
+// each calls fn for every cached member of a guild. fn must not modify the
+// member or call back into the cache.
+func (cache *memberCache) each(guildID string, fn func(discordID string, member *discordgo.Member)) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	for discordID, member := range cache.members[guildID] {
+		fn(discordID, member)
+	}
+}
+
+// parseMemberChunk decodes a raw GUILD_MEMBERS_CHUNK event
+func parseMemberChunk(event *discordgo.Event) (*memberChunk, error) {
+	chunk := new(memberChunk)
+	err := json.Unmarshal(event.RawData, chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func testMember(id int, roles ...string) *discordgo.Member {
+	return &discordgo.Member{
+		User:  &discordgo.User{ID: strconv.Itoa(id), Username: "user" + strconv.Itoa(id)},
+		Roles: roles,
+	}
+}
+
+// testChunks splits members 0..total-1 into chunks like discord does
+func testChunks(guildID string, total int, size int) []*memberChunk {
+	count := (total + size - 1) / size
+	chunks := make([]*memberChunk, count)
+	for index := range chunks {
+		chunks[index] = &memberChunk{
+			GuildID:    guildID,
+			ChunkIndex: index,
+			ChunkCount: count,
+		}
+	}
+
+	for id := 0; id < total; id++ {
+		chunk := chunks[id/size]
+		chunk.Members = append(chunk.Members, testMember(id))
+	}
+
+	return chunks
+}
+
+func TestMemberCacheOutOfOrderChunks(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+	cache.startLoad("guild")
+
+	chunks := testChunks("guild", 25, 10)
+	for _, index := range []int{2, 0} {
+		if drift := cache.addChunk(chunks[index]); drift != nil {
+			t.Fatalf("chunk %d completed the load", index)
+		}
+	}
+
+	if cache.count("guild") != 0 || cache.loadedGuilds()["guild"] {
+		t.Fatal("members were swapped in before all chunks arrived")
+	}
+
+	if drift := cache.addChunk(chunks[1]); drift == nil {
+		t.Fatal("last chunk did not complete the load")
+	}
+
+	if cache.count("guild") != 25 {
+		t.Fatalf("expected 25 members, got %d", cache.count("guild"))
+	}
+	if !cache.loadedGuilds()["guild"] {
+		t.Fatal("guild is not marked as loaded")
+	}
+}
+
+func TestMemberCacheExactMultipleOfChunkSize(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+	cache.startLoad("guild")
+
+	chunks := testChunks("guild", 3000, 1000)
+	for index, chunk := range chunks[:2] {
+		if drift := cache.addChunk(chunk); drift != nil {
+			t.Fatalf("full chunk %d completed the load", index)
+		}
+	}
+
+	// The same chunk twice must not count as two chunks
+	if drift := cache.addChunk(chunks[1]); drift != nil {
+		t.Fatal("a repeated chunk completed the load")
+	}
+	if cache.loadedGuilds()["guild"] {
+		t.Fatal("guild is marked as loaded before the last chunk")
+	}
+
+	if drift := cache.addChunk(chunks[2]); drift == nil {
+		t.Fatal("last chunk did not complete the load")
+	}
+	if cache.count("guild") != 3000 {
+		t.Fatalf("expected 3000 members, got %d", cache.count("guild"))
+	}
+}
+
+func TestMemberCacheChunkWithoutCount(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+	cache.startLoad("guild")
+
+	chunk := testChunks("guild", 10, 1000)[0]
+	chunk.ChunkCount = 0
+	if drift := cache.addChunk(chunk); drift != nil {
+		t.Fatal("a chunk without count completed the load")
+	}
+}
+
+func TestMemberCacheResetDuringLoad(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+	cache.startLoad("guild")
+
+	chunks := testChunks("guild", 20, 10)
+	cache.addChunk(chunks[0])
+	cache.reset("guild")
+
+	if drift := cache.addChunk(chunks[1]); drift != nil {
+		t.Fatal("a chunk of a load started before the reset completed it")
+	}
+	if cache.count("guild") != 0 || cache.loadedGuilds()["guild"] {
+		t.Fatal("members of the old load were swapped in")
+	}
+}
+
+func TestMemberCacheConcurrentAccess(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id := 10000 + worker*1000 + i
+				cache.set("guild", testMember(id, "role"))
+				cache.get("guild", strconv.Itoa(id))
+				cache.each("guild", func(discordID string, member *discordgo.Member) {
+					_ = member.Roles
+				})
+				cache.count("guild")
+				cache.counts()
+				cache.loadedGuilds()
+				if i%2 == 0 {
+					cache.remove("guild", strconv.Itoa(id))
+				}
+			}
+		}(worker)
+	}
+
+	for load := 0; load < 5; load++ {
+		cache.startLoad("guild")
+		for _, chunk := range testChunks("guild", 2500, 1000) {
+			cache.addChunk(chunk)
+		}
+	}
+
+	wg.Wait()
+
+	if !cache.loadedGuilds()["guild"] {
+		t.Fatal("guild is not marked as loaded")
+	}
+	if cache.count("guild") < 2500 {
+		t.Fatalf("expected at least 2500 members, got %d", cache.count("guild"))
+	}
+}
+
+func TestParseMemberChunk(t *testing.T) {
+	event := &discordgo.Event{
+		Type:    "GUILD_MEMBERS_CHUNK",
+		RawData: []byte(`{"guild_id":"1","chunk_index":1,"chunk_count":3,"members":[{"user":{"id":"42"},"roles":["7"]}]}`),
+	}
+
+	chunk, err := parseMemberChunk(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunk.GuildID != "1" || chunk.ChunkIndex != 1 || chunk.ChunkCount != 3 {
+		t.Fatalf("unexpected chunk %+v", chunk)
+	}
+	if len(chunk.Members) != 1 || chunk.Members[0].User.ID != "42" {
+		t.Fatalf("unexpected members %+v", chunk.Members)
+	}
+}
+
+func TestMemberCacheEventsDuringLoad(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+	cache.startLoad("guild")
+	for _, chunk := range testChunks("guild", 20, 10) {
+		cache.addChunk(chunk)
+	}
+
+	// Events arrive before the chunks of the next load with older data
+	cache.startLoad("guild")
+	cache.set("guild", testMember(3, "new"))
+	cache.remove("guild", "4")
+	cache.set("guild", testMember(42))
+
+	var drift *memberDrift
+	for _, chunk := range testChunks("guild", 20, 10) {
+		drift = cache.addChunk(chunk)
+	}
+
+	if drift == nil {
+		t.Fatal("load did not complete")
+	}
+	if drift.corrected() != 0 {
+		t.Fatalf("events were reported as drift: %+v", drift)
+	}
+
+	if member := cache.get("guild", "3"); member == nil || len(member.Roles) != 1 {
+		t.Fatal("chunk overwrote an updated member")
+	}
+	if cache.get("guild", "4") != nil {
+		t.Fatal("chunk brought back a removed member")
+	}
+	if cache.get("guild", "42") == nil {
+		t.Fatal("member that joined during the load is missing")
+	}
+}
+
+func TestMemberCacheDrift(t *testing.T) {
+	cache := newMemberCache()
+	cache.reset("guild")
+	cache.startLoad("guild")
+	for _, chunk := range testChunks("guild", 20, 10) {
+		cache.addChunk(chunk)
+	}
+
+	// Changes we missed the events of
+	cache.mutex.Lock()
+	delete(cache.members["guild"], "1")
+	cache.members["guild"]["2"] = testMember(2, "stale")
+	cache.members["guild"]["99"] = testMember(99)
+	cache.mutex.Unlock()
+
+	cache.startLoad("guild")
+	var drift *memberDrift
+	for _, chunk := range testChunks("guild", 20, 10) {
+		drift = cache.addChunk(chunk)
+	}
+
+	if drift == nil || drift.added != 1 || drift.removed != 1 || drift.updated != 1 {
+		t.Fatalf("unexpected drift %+v", drift)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	// Discord does not allow nicknames longer than that
+	nickMaxLength = 32
+	// Delay before we try again to set a nickname discord refused
+	nickRetryDelay = time.Minute * 10
+)
+
+// nickReport sums up what a nickname sync changed
+type nickReport struct {
+	changed   int
+	unchanged int
+	exempt    int
+	failed    int
+}
+
+func (r nickReport) String() string {
+	return strconv.Itoa(r.changed) + " changed, " +
+		strconv.Itoa(r.unchanged) + " unchanged, " +
+		strconv.Itoa(r.exempt) + " exempt, " +
+		strconv.Itoa(r.failed) + " failed"
+}
+
+// nickOptOuts returns all discord IDs that want to keep their own nickname
+func (bot *AwakenBot) nickOptOuts(ctx context.Context) (map[string]bool, error) {
+	optOuts := make(map[string]bool)
+
+	rows, err := bot.GetNickOptOuts.QueryContext(ctx)
+	if err != nil {
+		log.Errorln("Unable to get nickname opt-outs", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var discordID string
+
+		err := rows.Scan(&discordID)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		optOuts[discordID] = true
+	}
+
+	return optOuts, rows.Err()
+}
+
+// nickOptOut looks up the nickname opt-out of a single member, in the same
+// form as nickOptOuts
+func (bot *AwakenBot) nickOptOut(ctx context.Context, discordID string) (map[string]bool, error) {
+	var count int
+	err := bot.GetNickOptOut.QueryRowContext(ctx, discordID).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]bool{discordID: count > 0}, nil
+}
+
+// mainHeroes returns the main hero of every website user by user ID. It's
+// only queried if the nickname template uses it.
+func (bot *AwakenBot) mainHeroes(ctx context.Context) (map[string]string, error) {
+	heroes := make(map[string]string)
+	if !strings.Contains(MyConfig.NickTemplate, "{mainHero}") {
+		return heroes, nil
+	}
+
+	rows, err := bot.GetMainHeroes.QueryContext(ctx)
+	if err != nil {
+		log.Errorln("Unable to get main heroes", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, heroName string
+
+		err := rows.Scan(&userID, &heroName)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			continue
+		}
+
+		heroes[userID] = heroName
+	}
+
+	return heroes, rows.Err()
+}
+
+// mainHero looks up the main hero of a single website user, in the same
+// form as mainHeroes
+func (bot *AwakenBot) mainHero(ctx context.Context, userID string) (map[string]string, error) {
+	heroes := make(map[string]string)
+	if !strings.Contains(MyConfig.NickTemplate, "{mainHero}") {
+		return heroes, nil
+	}
+
+	var heroName string
+	err := bot.GetMainHeroByID.QueryRowContext(ctx, userID).Scan(&heroName)
+	if err == sql.ErrNoRows {
+		log.Debugln("No main hero for user", userID)
+		return heroes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	heroes[userID] = heroName
+	return heroes, nil
+}
+
+// nickFor renders the configured nickname template for a website user
+func (bot *AwakenBot) nickFor(userID string, username string, heroes map[string]string) string {
+	template := MyConfig.NickTemplate
+
+	heroName := heroes[userID]
+	// Don't leave a dangling separator for users without heroes
+	if heroName == "" && strings.Contains(template, "{mainHero}") {
+		template = withoutPlaceholder(template, "{mainHero}")
+	}
+
+	nick := strings.Replace(template, "{username}", username, -1)
+	nick = strings.TrimSpace(strings.Replace(nick, "{mainHero}", heroName, -1))
+
+	runes := []rune(nick)
+	if len(runes) > nickMaxLength {
+		nick = strings.TrimSpace(string(runes[:nickMaxLength]))
+	}
+
+	return nick
+}
+
+// withoutPlaceholder removes a placeholder and the separator text around it
+// from a template, e.g. "{username} | {mainHero}" becomes "{username}"
+func withoutPlaceholder(template string, placeholder string) string {
+	index := strings.Index(template, placeholder)
+	if index < 0 {
+		return template
+	}
+
+	before := template[:index]
+	after := template[index+len(placeholder):]
+
+	// The separator reaches back to the previous placeholder
+	previous := strings.LastIndex(before, "}")
+	before = before[:previous+1]
+
+	// Decoration around a placeholder at either end goes as well,
+	// e.g. "[{mainHero}] {username}"
+	next := strings.Index(after, "{")
+	if previous < 0 || next < 0 {
+		if next < 0 {
+			next = len(after)
+		}
+		after = after[next:]
+	}
+
+	return before + after
+}
+
+// highestRolePosition returns the position of the highest role of a member,
+// false if the member has no role
+func highestRolePosition(guild *discordgo.Guild, roles []string, s *discordgo.Session) (int, bool) {
+	highest := 0
+	found := false
+	for _, roleID := range roles {
+		role, err := s.State.Role(guild.ID, roleID)
+		if err != nil {
+			continue
+		}
+
+		if !found || role.Position > highest {
+			highest = role.Position
+			found = true
+		}
+	}
+
+	return highest, found
+}
+
+// nickExempt checks if the bot must not touch the nickname of a member
+func (bot *AwakenBot) nickExempt(guild *discordgo.Guild, member *discordgo.Member, optOuts map[string]bool, s *discordgo.Session) (bool, string) {
+	if member.User.ID == guild.OwnerID {
+		return true, "guild owner"
+	}
+
+	if optOuts[member.User.ID] {
+		return true, "opted out"
+	}
+
+	for _, slug := range MyConfig.NickExemptRoles {
+		roleID, ok := bot.rolesToIDMap[guild.ID][slug]
+		if !ok {
+			continue
+		}
+
+		for _, role := range member.Roles {
+			if role == roleID {
+				return true, "exempt role " + slug
+			}
+		}
+	}
+
+	// Members without a role are never above the bot
+	memberPosition, hasRole := highestRolePosition(guild, member.Roles, s)
+	self, err := s.State.Member(guild.ID, s.State.User.ID)
+	if err == nil && hasRole {
+		selfPosition, selfHasRole := highestRolePosition(guild, self.Roles, s)
+		if !selfHasRole {
+			return true, "bot has no role"
+		}
+
+		if memberPosition >= selfPosition {
+			return true, "above bot in role hierarchy"
+		}
+	}
+
+	return false, ""
+}
+
+// syncNick applies the nickname policy to a single member
+func (bot *AwakenBot) syncNick(guild *discordgo.Guild, discordID string, userID string, username string, heroes map[string]string, optOuts map[string]bool, report *nickReport, s *discordgo.Session) error {
+	member := bot.members.get(guild.ID, discordID)
+
+	if member == nil {
+		var err error
+		member, err = s.State.Member(guild.ID, discordID)
+		if err != nil {
+			// Not on this guild
+			return nil
+		}
+	}
+
+	if exempt, reason := bot.nickExempt(guild, member, optOuts, s); exempt {
+		log.Debugln("Not setting nickname of", discordID, "-", reason)
+		report.exempt++
+		return nil
+	}
+
+	nick := bot.nickFor(userID, username, heroes)
+	if nick == "" || nick == member.Nick || (member.Nick == "" && nick == member.User.Username) {
+		report.unchanged++
+		return nil
+	}
+
+	err := s.GuildMemberNickname(guild.ID, discordID, nick)
+	if err != nil {
+		log.Errorln("Unable to set member nickname to "+nick, err.Error())
+		report.failed++
+		return err
+	}
+
+	log.Debugln("Changed nickname of", discordID, "from", member.Nick, "to", nick)
+	report.changed++
+	return nil
+}
+
+// syncNickByDiscordID looks up the website user and syncs the nickname
+func (bot *AwakenBot) syncNickByDiscordID(ctx context.Context, guild *discordgo.Guild, discordID string, s *discordgo.Session) error {
+	var userID string
+	err := bot.GetIDByDiscordID.QueryRowContext(ctx, discordID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		// Unlinked in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	optOuts, err := bot.nickOptOut(ctx, discordID)
+	if err != nil {
+		return err
+	}
+
+	var id, username, email, birthday, ipAddress, discordName, discordEmail, discordDiscriminator, sqlDiscordID sql.NullString
+	err = bot.GetUserWithDiscord.QueryRowContext(ctx, userID).Scan(&id, &username, &email, &birthday, &ipAddress, &discordName, &discordEmail, &discordDiscriminator, &sqlDiscordID)
+	if err != nil {
+		return err
+	}
+
+	heroes, err := bot.mainHero(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	report := nickReport{}
+	return bot.syncNick(guild, discordID, userID, username.String, heroes, optOuts, &report, s)
+}
+
+// retryNick schedules another try if discord failed to set a nickname,
+// unless one is waiting already
+func (bot *AwakenBot) retryNick(guild *discordgo.Guild, discordID string, err error) {
+	if err == nil || !isRetryable(err) {
+		return
+	}
+
+	_, err = bot.scheduleOnce(nickJob{guildID: guild.ID, discordID: discordID}, time.Now().Add(nickRetryDelay))
+	if err != nil {
+		log.Errorln("Could not schedule nickname retry for", discordID, err.Error())
+	}
+}
+
+func (bot *AwakenBot) cmdNick(s *discordgo.Session, c *discordgo.Channel, g *discordgo.Guild, m *discordgo.MessageCreate, args []string) string {
+	if len(args) != 1 || (args[0] != "keep" && args[0] != "sync") {
+		bot.send(m.Author.ID, "Please use "+bot.prefix+" nick keep|sync", c, g, s)
+		return outcomeUsage
+	}
+
+	if args[0] == "keep" {
+		_, err := bot.InsertNickOptOut.Exec(m.Author.ID)
+		if err != nil {
+			log.Errorln("Could not store nickname opt-out", err.Error())
+			bot.send(m.Author.ID, "Could not store your choice. Please try again.", c, g, s)
+			return outcomeInternal
+		}
+
+		bot.send(m.Author.ID, "We will no longer change your nickname.", c, g, s)
+		return outcomeSuccess
+	}
+
+	_, err := bot.DeleteNickOptOut.Exec(m.Author.ID)
+	if err != nil {
+		log.Errorln("Could not remove nickname opt-out", err.Error())
+		bot.send(m.Author.ID, "Could not store your choice. Please try again.", c, g, s)
+		return outcomeInternal
+	}
+
+	bot.send(m.Author.ID, "Your nickname will be synced with the homepage again.", c, g, s)
+	return outcomeSuccess
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithoutPlaceholder(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{username} | {mainHero}", "{username}"},
+		{"{mainHero} - {username}", "{username}"},
+		{"[{mainHero}] {username}", "{username}"},
+		{"{username} [{mainHero}]", "{username}"},
+		{"{username}", "{username}"},
+		{"{mainHero}", ""},
+	}
+
+	for _, test := range tests {
+		if got := withoutPlaceholder(test.template, "{mainHero}"); got != test.want {
+			t.Errorf("withoutPlaceholder(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestNickFor(t *testing.T) {
+	defer func(template string) { MyConfig.NickTemplate = template }(MyConfig.NickTemplate)
+
+	tests := []struct {
+		template string
+		username string
+		hero     string
+		want     string
+	}{
+		{"{username}", "player", "", "player"},
+		{"{username} | {mainHero}", "player", "Knight", "player | Knight"},
+		{"{username} | {mainHero}", "player", "", "player"},
+		{"[HA] {username}", "player", "", "[HA] player"},
+		{" {username} ", "player", "", "player"},
+		{"{username}", strings.Repeat("a", 40), "", strings.Repeat("a", nickMaxLength)},
+		{"{username}", strings.Repeat("ä", 40), "", strings.Repeat("ä", nickMaxLength)},
+		{"[HA] {username}", strings.Repeat("a", 27) + " b", "", "[HA] " + strings.Repeat("a", 27)},
+	}
+
+	bot := &AwakenBot{}
+	for _, test := range tests {
+		MyConfig.NickTemplate = test.template
+		if got := bot.nickFor("1", test.username, map[string]string{"1": test.hero}); got != test.want {
+			t.Errorf("nickFor(%q, %q) = %q, want %q", test.template, test.username, got, test.want)
+		}
+	}
+}
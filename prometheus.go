@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric backends selectable in the config
+const (
+	metricsInflux     = "influx"
+	metricsPrometheus = "prometheus"
+	metricsBoth       = "both"
+)
+
+const (
+	// Prefix of all exposed metric names
+	promNamespace = "awakenbot"
+	// Series that weren't updated for that long are dropped, e.g. deleted roles
+	promSeriesTTL = time.Minute * 5
+)
+
+var (
+	promInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+	promCamelCase    = regexp.MustCompile("([a-z0-9])([A-Z])")
+	promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// promSample is the last value of a single series
+type promSample struct {
+	value   float64
+	updated time.Time
+}
+
+// promRegistry keeps the last value of every metric so prometheus can
+// scrape them, instead of us pushing them
+type promRegistry struct {
+	sync.Mutex
+	// metric name -> label set -> sample
+	series map[string]map[string]*promSample
+}
+
+func newPromRegistry() *promRegistry {
+	return &promRegistry{
+		series: make(map[string]map[string]*promSample),
+	}
+}
+
+// promName turns a name like totalMembers into total_members
+func promName(name string) string {
+	name = promCamelCase.ReplaceAllString(name, "${1}_${2}")
+	return strings.ToLower(promInvalidChars.ReplaceAllString(name, "_"))
+}
+
+// promValue converts a metric field, it returns false for non numeric fields
+func promValue(field interface{}) (float64, bool) {
+	switch value := field.(type) {
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// labelKey identifies a label set within a metric
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(key)
+		buf.WriteString(`="`)
+		buf.WriteString(promLabelEscaper.Replace(labels[key]))
+		buf.WriteString(`",`)
+	}
+
+	return strings.TrimSuffix(buf.String(), ",")
+}
+
+// AddMetric stores a metric the same way it would be sent to influxdb. The
+// metric tag and field make up the name, all other tags become labels.
+func (p *promRegistry) AddMetric(name string, tags map[string]string, fields map[string]interface{}) error {
+	prefix := name
+	if metric, ok := tags["metric"]; ok {
+		prefix = metric
+	}
+
+	labels := make(map[string]string)
+	for key, value := range tags {
+		if key == "metric" {
+			continue
+		}
+		labels[promName(key)] = value
+	}
+	key := labelKey(labels)
+
+	now := time.Now()
+	p.Lock()
+	defer p.Unlock()
+
+	for field, raw := range fields {
+		value, ok := promValue(raw)
+		if !ok {
+			continue
+		}
+
+		metricName := promNamespace + "_" + promName(prefix) + "_" + promName(field)
+		if p.series[metricName] == nil {
+			p.series[metricName] = make(map[string]*promSample)
+		}
+
+		p.series[metricName][key] = &promSample{value: value, updated: now}
+	}
+
+	return nil
+}
+
+// ServeHTTP writes all metrics in the prometheus text format
+func (p *promRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	p.Lock()
+	names := make([]string, 0, len(p.series))
+	for name, samples := range p.series {
+		for key, sample := range samples {
+			if time.Since(sample.updated) > promSeriesTTL {
+				delete(samples, key)
+			}
+		}
+
+		if len(samples) == 0 {
+			delete(p.series, name)
+			continue
+		}
+
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		keys := make([]string, 0, len(p.series[name]))
+		for key := range p.series[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteString("# TYPE " + name + " gauge\n")
+		for _, key := range keys {
+			buf.WriteString(name)
+			if key != "" {
+				buf.WriteString("{" + key + "}")
+			}
+			buf.WriteString(" " + strconv.FormatFloat(p.series[name][key].value, 'g', -1, 64) + "\n")
+		}
+	}
+	p.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
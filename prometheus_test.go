@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestPromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"members", "members"},
+		{"onlineMembers", "online_members"},
+		{"jobsQueued2Total", "jobs_queued2_total"},
+		{"role.count", "role_count"},
+		{"guild-members online", "guild_members_online"},
+		{"already_snake", "already_snake"},
+	}
+
+	for _, test := range tests {
+		if got := promName(test.name); got != test.want {
+			t.Errorf("promName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// markUnlinked remembers when we first saw a member without a linked account
+func (bot *AwakenBot) markUnlinked(guildID string, discordID string) {
+	_, err := bot.InsertUnlinked.Exec(guildID, discordID, time.Now().Unix())
+	if err != nil {
+		log.Errorln("Could not mark member "+discordID+" as unlinked", err.Error())
+	}
+}
+
+// warnUnlinked remembers that a member was told about the removal of their
+// roles. The grace period starts with the warning.
+func (bot *AwakenBot) warnUnlinked(guildID string, discordID string) error {
+	_, err := bot.WarnUnlinked.Exec(guildID, discordID, time.Now().Unix())
+	if err != nil {
+		log.Errorln("Could not mark member "+discordID+" as warned", err.Error())
+	}
+
+	return err
+}
+
+// clearUnlinked forgets a member that linked again or left the guild
+func (bot *AwakenBot) clearUnlinked(guildID string, discordID string) {
+	_, err := bot.DeleteUnlinked.Exec(guildID, discordID)
+	if err != nil {
+		log.Errorln("Could not clear unlinked member "+discordID, err.Error())
+	}
+}
+
+// managedRoles returns the IDs of all roles the bot assigns in a guild
+func (bot *AwakenBot) managedRoles(guildID string) map[string]bool {
+	roles := make(map[string]bool)
+	for _, roleID := range bot.rolesToIDMap[guildID] {
+		roles[roleID] = true
+	}
+
+	return roles
+}
+
+// reconcileGuild strips managed roles from members that have no linked
+// account anymore once the grace period passed
+func (bot *AwakenBot) reconcileGuild(ctx context.Context, guild *discordgo.Guild, s *discordgo.Session) error {
+	// A partial member list would clear the grace period of everyone missing
+	if !bot.members.loadedGuilds()[guild.ID] {
+		return errMembersLoading
+	}
+
+	rows, err := bot.GetLinkedDiscordIDs.QueryContext(ctx)
+	if err != nil {
+		log.Errorln("Unable to get linked Discord Users", err.Error())
+		return err
+	}
+	defer rows.Close()
+
+	linked := make(map[string]bool)
+	for rows.Next() {
+		var discordID string
+
+		err := rows.Scan(&discordID)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			return err
+		}
+
+		linked[discordID] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	pending := make(map[string]int64)
+	// Members can be marked as unlinked by a refresh before we warned them
+	warned := make(map[string]bool)
+	pendingRows, err := bot.GetUnlinkedByGuild.QueryContext(ctx, guild.ID)
+	if err != nil {
+		log.Errorln("Unable to get unlinked members", err.Error())
+		return err
+	}
+	defer pendingRows.Close()
+
+	for pendingRows.Next() {
+		var discordID string
+		var firstSeen int64
+		var wasWarned bool
+
+		err := pendingRows.Scan(&discordID, &firstSeen, &wasWarned)
+		if err != nil {
+			log.Errorln("Issue with database:", err.Error())
+			return err
+		}
+
+		pending[discordID] = firstSeen
+		warned[discordID] = wasWarned
+	}
+
+	managed := bot.managedRoles(guild.ID)
+	unlinked := make(map[string][]string)
+
+	bot.members.each(guild.ID, func(discordID string, member *discordgo.Member) {
+		if linked[discordID] || member.User.Bot {
+			return
+		}
+
+		for _, role := range member.Roles {
+			if managed[role] {
+				unlinked[discordID] = append(unlinked[discordID], role)
+			}
+		}
+	})
+
+	// Forget members that linked again, left or lost their roles otherwise
+	for discordID := range pending {
+		if _, ok := unlinked[discordID]; !ok {
+			bot.clearUnlinked(guild.ID, discordID)
+		}
+	}
+
+	grace := time.Duration(MyConfig.UnlinkedGraceHours) * time.Hour
+	stripped := 0
+	for discordID, roles := range unlinked {
+		if ctx.Err() != nil {
+			return errPermanent{ctx.Err()}
+		}
+
+		if !warned[discordID] {
+			log.Noteln("Member", discordID, "in", guild.Name, "holds managed roles without a linked account")
+			if err := bot.warnUnlinked(guild.ID, discordID); err != nil {
+				// Don't warn again every run, the next one tries again
+				continue
+			}
+			bot.send(discordID, "Your discord account is no longer linked on the homepage.\nHead to https://heroesawaken.com/profile/link/discord to link it again, otherwise your roles on "+guild.Name+" will be removed in "+strconv.Itoa(MyConfig.UnlinkedGraceHours)+" hours.", nil, guild, s)
+			continue
+		}
+
+		if time.Since(time.Unix(pending[discordID], 0)) < grace {
+			continue
+		}
+
+		for _, roleID := range roles {
+			err := s.GuildMemberRoleRemove(guild.ID, discordID, roleID)
+			if err != nil {
+				log.Errorln("Could not remove role "+roleID+" from unlinked member "+discordID, err.Error())
+			}
+		}
+
+		log.Noteln("Removed", len(roles), "managed roles from unlinked member", discordID, "in", guild.Name)
+		bot.send(discordID, "Your roles on "+guild.Name+" were removed because your discord account is not linked on the homepage.\nHead to https://heroesawaken.com/profile/link/discord to link your Account and get them back! :)", nil, guild, s)
+		bot.clearUnlinked(guild.ID, discordID)
+		stripped++
+	}
+
+	log.Noteln("Reconciled " + guild.Name + ": " + strconv.Itoa(len(unlinked)) + " unlinked, " + strconv.Itoa(stripped) + " stripped.")
+	return nil
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/HeroesAwaken/GoAwaken/Log"
 	"golang.org/x/crypto/ssh"
 )
 
+// sshTunnel holds the tunnel connection, so its health can be checked
+var sshTunnel struct {
+	sync.Mutex
+	client      *ssh.Client
+	connections int
+}
+
 // Get default location of a private key
 func privateKeyPath() string {
 	return os.Getenv("HOME") + "/.ssh/id_rsa"
@@ -46,6 +56,16 @@ func handleClient(client net.Conn, sshClient *ssh.Client, remoteAddr string) {
 	defer client.Close()
 	chDone := make(chan bool)
 
+	sshTunnel.Lock()
+	sshTunnel.connections++
+	sshTunnel.Unlock()
+
+	defer func() {
+		sshTunnel.Lock()
+		sshTunnel.connections--
+		sshTunnel.Unlock()
+	}()
+
 	// Establish connection with remote server
 	remote, err := sshClient.Dial("tcp", remoteAddr)
 	if err != nil {
@@ -88,6 +108,10 @@ func startRemoveCon(sshAddr, localAddr, remoteAddr string) {
 		log.Fatalln(err)
 	}
 
+	sshTunnel.Lock()
+	sshTunnel.client = conn
+	sshTunnel.Unlock()
+
 	// Start local server to forward traffic to remote connection
 	local, err := net.Listen("tcp", localAddr)
 	if err != nil {
@@ -109,3 +133,35 @@ func startRemoveCon(sshAddr, localAddr, remoteAddr string) {
 		conn.Close()
 	}()
 }
+
+// checkTunnel sends a keepalive through the SSH tunnel
+func checkTunnel(timeout time.Duration) error {
+	sshTunnel.Lock()
+	client := sshTunnel.client
+	sshTunnel.Unlock()
+
+	if client == nil {
+		return errors.New("SSH tunnel not connected")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.New("SSH tunnel keepalive timed out")
+	}
+}
+
+// tunnelConnections returns the amount of connections through the tunnel
+func tunnelConnections() int {
+	sshTunnel.Lock()
+	defer sshTunnel.Unlock()
+
+	return sshTunnel.connections
+}
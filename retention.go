@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+const (
+	// Members that joined within that time before the retention period are
+	// used to calculate the retention
+	retentionCohort = time.Hour * 24 * 30
+	// How often the retention is calculated
+	retentionInterval = time.Hour
+)
+
+// Days after joining we check if members are still around
+var retentionDays = []int{1, 7, 30}
+
+// retentionStat is the retention of linked or unlinked members after some days
+type retentionStat struct {
+	days     int
+	linked   bool
+	joined   int
+	retained int
+}
+
+// rate returns the share of members still present
+func (r retentionStat) rate() float64 {
+	if r.joined == 0 {
+		return 0
+	}
+
+	return float64(r.retained) / float64(r.joined)
+}
+
+// recordJoin stores that a member joined a guild
+func (bot *AwakenBot) recordJoin(guildID string, discordID string, at time.Time) {
+	bot.memberEventsMutex.Lock()
+	bot.memberJoins[guildID]++
+	bot.memberEventsMutex.Unlock()
+
+	_, err := bot.InsertMemberJoin.Exec(guildID, discordID, at.Unix())
+	if err != nil {
+		log.Errorln("Could not store join of member "+discordID, err.Error())
+	}
+}
+
+// recordLeave stores that a member left a guild and whether they were linked
+func (bot *AwakenBot) recordLeave(guildID string, discordID string, at time.Time) {
+	bot.memberEventsMutex.Lock()
+	bot.memberLeaves[guildID]++
+	bot.memberEventsMutex.Unlock()
+
+	_, err := bot.UpdateMemberLeave.Exec(at.Unix(), discordID, guildID, discordID)
+	if err != nil {
+		log.Errorln("Could not store leave of member "+discordID, err.Error())
+	}
+}
+
+// retention calculates how many members are still around some days after
+// they joined, split by linked and unlinked members
+func (bot *AwakenBot) retention(ctx context.Context, guildID string) ([]retentionStat, error) {
+	var stats []retentionStat
+
+	for _, days := range retentionDays {
+		period := time.Hour * 24 * time.Duration(days)
+		until := time.Now().Add(-period)
+		since := until.Add(-retentionCohort)
+
+		// Always report both, even if nobody joined
+		byLinked := map[bool]*retentionStat{
+			true:  {days: days, linked: true},
+			false: {days: days, linked: false},
+		}
+
+		rows, err := bot.GetRetention.QueryContext(ctx, int64(period.Seconds()), guildID, since.Unix(), until.Unix())
+		if err != nil {
+			log.Errorln("Unable to get retention", err.Error())
+			return nil, err
+		}
+
+		for rows.Next() {
+			var linked bool
+			var joined, retained int
+
+			err := rows.Scan(&linked, &joined, &retained)
+			if err != nil {
+				rows.Close()
+				log.Errorln("Issue with database:", err.Error())
+				return nil, err
+			}
+
+			byLinked[linked].joined = joined
+			byLinked[linked].retained = retained
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, *byLinked[true], *byLinked[false])
+	}
+
+	return stats, nil
+}
+
+// updateRetention recalculates the retention metrics of a guild
+func (bot *AwakenBot) updateRetention(ctx context.Context, guild *discordgo.Guild) error {
+	stats, err := bot.retention(ctx, guild.ID)
+	if err != nil {
+		return err
+	}
+
+	bot.memberEventsMutex.Lock()
+	bot.retentionStats[guild.ID] = stats
+	bot.memberEventsMutex.Unlock()
+
+	return nil
+}
+
+// metricMemberEvents sends joins, leaves and the last calculated retention
+func (bot *AwakenBot) metricMemberEvents(g *discordgo.Guild) {
+	bot.memberEventsMutex.Lock()
+	joins := bot.memberJoins[g.ID]
+	leaves := bot.memberLeaves[g.ID]
+	stats := bot.retentionStats[g.ID]
+	bot.memberEventsMutex.Unlock()
+
+	tags := map[string]string{"metric": "member_events", "server": g.Name}
+	fields := map[string]interface{}{
+		"joins":  joins,
+		"leaves": leaves,
+	}
+
+	bot.addMetric("discord_metrics", tags, fields)
+
+	for _, stat := range stats {
+		tags := map[string]string{
+			"metric": "member_retention",
+			"server": g.Name,
+			"days":   strconv.Itoa(stat.days),
+			"linked": strconv.FormatBool(stat.linked),
+		}
+		fields := map[string]interface{}{
+			"joined":   stat.joined,
+			"retained": stat.retained,
+			"rate":     stat.rate(),
+		}
+
+		bot.addMetric("discord_metrics", tags, fields)
+	}
+}
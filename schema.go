@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// schemaMigrations holds the tables owned by the bot itself.
+// Only ever append to this list, the index is stored as schema version.
+var schemaMigrations = []string{
+	"CREATE TABLE IF NOT EXISTS bot_unlinked_members (" +
+		"	guild_id VARCHAR(32) NOT NULL," +
+		"	discord_id VARCHAR(32) NOT NULL," +
+		"	first_seen BIGINT NOT NULL," +
+		"	PRIMARY KEY (guild_id, discord_id)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS bot_nick_optout (" +
+		"	discord_id VARCHAR(32) NOT NULL," +
+		"	PRIMARY KEY (discord_id)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS bot_jobs (" +
+		"	id BIGINT NOT NULL AUTO_INCREMENT," +
+		"	job_type VARCHAR(32) NOT NULL," +
+		"	guild_id VARCHAR(32) NOT NULL," +
+		"	payload VARCHAR(255) NOT NULL," +
+		"	state VARCHAR(16) NOT NULL," +
+		"	attempts INT NOT NULL DEFAULT 0," +
+		"	last_error TEXT NULL," +
+		"	created_at BIGINT NOT NULL," +
+		"	started_at BIGINT NULL," +
+		"	finished_at BIGINT NULL," +
+		"	PRIMARY KEY (id)," +
+		"	KEY state (state)" +
+		")",
+	"ALTER TABLE bot_jobs" +
+		"	ADD COLUMN run_at BIGINT NOT NULL DEFAULT 0," +
+		"	ADD KEY state_run_at (state, run_at)",
+	"CREATE TABLE IF NOT EXISTS bot_member_events (" +
+		"	id BIGINT NOT NULL AUTO_INCREMENT," +
+		"	guild_id VARCHAR(32) NOT NULL," +
+		"	discord_id VARCHAR(32) NOT NULL," +
+		"	joined_at BIGINT NOT NULL," +
+		"	left_at BIGINT NULL," +
+		"	linked TINYINT(1) NULL," +
+		"	PRIMARY KEY (id)," +
+		"	KEY guild_joined (guild_id, joined_at)," +
+		"	KEY guild_member (guild_id, discord_id)" +
+		")",
+	"ALTER TABLE bot_unlinked_members" +
+		"	ADD COLUMN warned TINYINT(1) NOT NULL DEFAULT 0",
+}
+
+// migrateSchema creates or updates all bot owned tables
+func (bot *AwakenBot) migrateSchema() {
+	_, err := bot.DB.Exec("CREATE TABLE IF NOT EXISTS bot_schema_version (version INT NOT NULL)")
+	if err != nil {
+		log.Fatalln("Could not create bot_schema_version.", err.Error())
+	}
+
+	version := 0
+	err = bot.DB.QueryRow("SELECT COALESCE(MAX(version), 0) FROM bot_schema_version").Scan(&version)
+	if err != nil {
+		log.Fatalln("Could not get schema version.", err.Error())
+	}
+
+	for index := version; index < len(schemaMigrations); index++ {
+		log.Noteln("Applying schema migration", index+1)
+
+		_, err = bot.DB.Exec(schemaMigrations[index])
+		if err != nil {
+			log.Fatalln("Could not apply schema migration", index+1, err.Error())
+		}
+
+		_, err = bot.DB.Exec("INSERT INTO bot_schema_version (version) VALUES (?)", index+1)
+		if err != nil {
+			log.Fatalln("Could not store schema version", index+1, err.Error())
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+	"github.com/HeroesAwaken/GoAwaken/core"
+)
+
+// Metric sinks selectable in the config, besides influx and prometheus
+const (
+	metricsStatsd = "statsd"
+	metricsFile   = "file"
+	metricsNone   = "none"
+)
+
+// metricsSink receives all metrics the bot collects
+type metricsSink interface {
+	AddMetric(name string, tags map[string]string, fields map[string]interface{}) error
+}
+
+// noopSink throws all metrics away
+type noopSink struct{}
+
+func (noopSink) AddMetric(name string, tags map[string]string, fields map[string]interface{}) error {
+	return nil
+}
+
+// multiSink sends metrics to several sinks
+type multiSink []metricsSink
+
+func (sinks multiSink) AddMetric(name string, tags map[string]string, fields map[string]interface{}) error {
+	var errs []string
+	for _, sink := range sinks {
+		err := sink.AddMetric(name, tags, fields)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// statsdSink sends metrics as gauges over UDP, tags use the DogStatsD format
+type statsdSink struct {
+	conn net.Conn
+}
+
+func newStatsdSink(addr string) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdSink{conn: conn}, nil
+}
+
+func (sink *statsdSink) AddMetric(name string, tags map[string]string, fields map[string]interface{}) error {
+	prefix := name
+	if metric, ok := tags["metric"]; ok {
+		prefix = metric
+	}
+
+	var tagList []string
+	for key, value := range tags {
+		if key == "metric" {
+			continue
+		}
+		tagList = append(tagList, promName(key)+":"+strings.Replace(value, ",", "_", -1))
+	}
+	sort.Strings(tagList)
+
+	suffix := "|g"
+	if len(tagList) > 0 {
+		suffix += "|#" + strings.Join(tagList, ",")
+	}
+
+	var lines []string
+	for field, raw := range fields {
+		value, ok := promValue(raw)
+		if !ok {
+			continue
+		}
+
+		lines = append(lines, promNamespace+"."+promName(prefix)+"."+promName(field)+":"+fmt.Sprint(value)+suffix)
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	_, err := sink.conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
+
+// fileSink appends metrics as JSON lines to a file, mostly for debugging
+type fileSink struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{encoder: json.NewEncoder(file)}, nil
+}
+
+func (sink *fileSink) AddMetric(name string, tags map[string]string, fields map[string]interface{}) error {
+	sink.Lock()
+	defer sink.Unlock()
+
+	return sink.encoder.Encode(map[string]interface{}{
+		"time":   time.Now(),
+		"name":   name,
+		"tags":   tags,
+		"fields": fields,
+	})
+}
+
+// connectInflux connects to the configured influx database
+func connectInflux() (metricsSink, error) {
+	influx := new(core.InfluxDB)
+	err := influx.New(MyConfig.InfluxDBHost, MyConfig.InfluxDBDatabase, MyConfig.InfluxDBUser, MyConfig.InfluxDBPassword, AppName, Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return influx, nil
+}
+
+// newMetricsSink builds the sinks listed in the config. Sinks that are not
+// available are left out, so the bot runs without metrics instead of dying.
+func newMetricsSink() (metricsSink, *promRegistry, *spoolSink) {
+	var sinks multiSink
+	var prometheus *promRegistry
+	var spool *spoolSink
+
+	for _, backend := range strings.Split(MyConfig.MetricsBackend, ",") {
+		backend = strings.TrimSpace(backend)
+		switch backend {
+		case metricsInflux, metricsBoth:
+			if MyConfig.MetricsSpool != "" {
+				// The spool keeps trying to connect if influx is down
+				writer := newInfluxWriter(MyConfig.InfluxDBHost, MyConfig.InfluxDBDatabase, MyConfig.InfluxDBUser, MyConfig.InfluxDBPassword)
+				spool = newSpoolSink(connectInflux, writer, MyConfig.MetricsSpool, int64(MyConfig.MetricsSpoolMaxMB)*1024*1024, time.Duration(MyConfig.MetricsSpoolMaxHours)*time.Hour)
+				sinks = append(sinks, spool)
+			} else if influx, err := connectInflux(); err != nil {
+				log.Warningln("Error connecting to MetricsDB, not sending metrics to influx:", err)
+			} else {
+				sinks = append(sinks, influx)
+			}
+
+			if backend != metricsBoth {
+				break
+			}
+			fallthrough
+		case metricsPrometheus:
+			if prometheus == nil {
+				prometheus = newPromRegistry()
+				sinks = append(sinks, prometheus)
+			}
+		case metricsStatsd:
+			statsd, err := newStatsdSink(MyConfig.StatsdAddr)
+			if err != nil {
+				log.Warningln("Error connecting to statsd, not sending metrics to it:", err)
+				continue
+			}
+			sinks = append(sinks, statsd)
+		case metricsFile:
+			file, err := newFileSink(MyConfig.MetricsFile)
+			if err != nil {
+				log.Warningln("Could not open metrics file, not writing metrics to it:", err)
+				continue
+			}
+			sinks = append(sinks, file)
+		case metricsNone, "":
+		default:
+			log.Warningln("Unknown metrics backend", backend)
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		return noopSink{}, prometheus, spool
+	case 1:
+		return sinks[0], prometheus, spool
+	}
+
+	return sinks, prometheus, spool
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HeroesAwaken/GoAwaken/Log"
+)
+
+const (
+	// How often we try to send spooled metrics again
+	spoolReplayInterval = time.Second * 10
+	// Metrics sent to influx in one request while replaying
+	spoolReplayBatch = 500
+	// Longer lines are not a metric we wrote, they are dropped
+	spoolMaxLine = 1024 * 1024
+)
+
+// spoolPoint is a metric waiting in the spool. Fields are split by type,
+// JSON would turn every number into a float and influx rejects type changes.
+type spoolPoint struct {
+	Time    time.Time          `json:"time"`
+	Name    string             `json:"name"`
+	Tags    map[string]string  `json:"tags"`
+	Ints    map[string]int64   `json:"ints,omitempty"`
+	Floats  map[string]float64 `json:"floats,omitempty"`
+	Bools   map[string]bool    `json:"bools,omitempty"`
+	Strings map[string]string  `json:"strings,omitempty"`
+}
+
+func newSpoolPoint(name string, tags map[string]string, fields map[string]interface{}) spoolPoint {
+	point := spoolPoint{
+		Time:    time.Now(),
+		Name:    name,
+		Tags:    tags,
+		Ints:    make(map[string]int64),
+		Floats:  make(map[string]float64),
+		Bools:   make(map[string]bool),
+		Strings: make(map[string]string),
+	}
+
+	for key, raw := range fields {
+		switch value := raw.(type) {
+		case int:
+			point.Ints[key] = int64(value)
+		case int64:
+			point.Ints[key] = value
+		case uint64:
+			point.Ints[key] = int64(value)
+		case float64:
+			point.Floats[key] = value
+		case bool:
+			point.Bools[key] = value
+		case string:
+			point.Strings[key] = value
+		}
+	}
+
+	return point
+}
+
+func (point spoolPoint) fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	for key, value := range point.Ints {
+		fields[key] = value
+	}
+	for key, value := range point.Floats {
+		fields[key] = value
+	}
+	for key, value := range point.Bools {
+		fields[key] = value
+	}
+	for key, value := range point.Strings {
+		fields[key] = value
+	}
+
+	return fields
+}
+
+// spoolSink keeps metrics on disk while the wrapped sink fails and sends
+// them in order once it works again. Replayed metrics are written with the
+// time they were collected.
+type spoolSink struct {
+	sync.Mutex
+	// nil until we could connect to influx
+	sink     metricsSink
+	connect  func() (metricsSink, error)
+	writer   *influxWriter
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+
+	depth    int
+	bytes    int64
+	dropped  int
+	replayed int
+}
+
+// spoolStats is a snapshot of the spool for metrics
+type spoolStats struct {
+	depth    int
+	bytes    int64
+	dropped  int
+	replayed int
+}
+
+func newSpoolSink(connect func() (metricsSink, error), writer *influxWriter, path string, maxBytes int64, maxAge time.Duration) *spoolSink {
+	spool := &spoolSink{
+		connect:  connect,
+		writer:   writer,
+		path:     path,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}
+
+	// Pick up what was left from the last run
+	file, err := os.Open(path)
+	if err == nil {
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				spool.depth++
+				spool.bytes += int64(len(line))
+			}
+			if err != nil {
+				break
+			}
+		}
+		file.Close()
+
+		log.Noteln("Found", spool.depth, "spooled metrics")
+	}
+
+	spool.reconnect()
+
+	go func() {
+		for range time.Tick(spoolReplayInterval) {
+			spool.reconnect()
+			spool.replay()
+		}
+	}()
+
+	return spool
+}
+
+// reconnect connects to influx if that failed so far
+func (spool *spoolSink) reconnect() {
+	spool.Lock()
+	connected := spool.sink != nil
+	spool.Unlock()
+
+	if connected {
+		return
+	}
+
+	sink, err := spool.connect()
+	if err != nil {
+		log.Warningln("Error connecting to MetricsDB, spooling metrics:", err)
+		return
+	}
+
+	spool.Lock()
+	spool.sink = sink
+	spool.Unlock()
+	log.Noteln("Connected to MetricsDB")
+}
+
+// AddMetric sends a metric, it's spooled if the sink fails or older
+// metrics are still waiting. The sink is called without holding the lock,
+// so a hanging write doesn't stall the other metrics.
+func (spool *spoolSink) AddMetric(name string, tags map[string]string, fields map[string]interface{}) error {
+	// Spooled points keep the time they were collected
+	point := newSpoolPoint(name, tags, fields)
+
+	spool.Lock()
+	sink := spool.sink
+	if spool.depth > 0 || sink == nil {
+		spool.append(point)
+		spool.Unlock()
+		return nil
+	}
+	spool.Unlock()
+
+	err := sink.AddMetric(name, tags, fields)
+	if err == nil {
+		return nil
+	}
+
+	spool.Lock()
+	spool.append(point)
+	spool.Unlock()
+	return err
+}
+
+// append writes a point to the spool, the spool lock has to be held
+func (spool *spoolSink) append(point spoolPoint) {
+	line, err := json.Marshal(point)
+	if err != nil {
+		log.Errorln("Could not encode metric for the spool", err.Error())
+		spool.dropped++
+		return
+	}
+	line = append(line, '\n')
+
+	if spool.bytes+int64(len(line)) > spool.maxBytes || len(line) > spoolMaxLine {
+		spool.dropped++
+		return
+	}
+
+	file, err := os.OpenFile(spool.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorln("Could not open metrics spool", err.Error())
+		spool.dropped++
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(line)
+	if err != nil {
+		log.Errorln("Could not write metrics spool", err.Error())
+		spool.dropped++
+		return
+	}
+
+	spool.depth++
+	spool.bytes += int64(len(line))
+}
+
+// replay sends spooled metrics until influx fails again. Metrics are sent
+// without holding the lock, new ones are appended to the spool meanwhile.
+func (spool *spoolSink) replay() {
+	spool.Lock()
+	size := spool.bytes
+	spool.Unlock()
+
+	if size == 0 {
+		return
+	}
+
+	file, err := os.Open(spool.path)
+	if err != nil {
+		log.Errorln("Could not open metrics spool", err.Error())
+		return
+	}
+
+	// Lines are only removed once the batch they are part of was sent
+	var batch []spoolPoint
+	var batchBytes int64
+	batchLines, batchDropped := 0, 0
+
+	var done int64
+	doneLines, replayed, dropped := 0, 0, 0
+	flush := func() bool {
+		if len(batch) > 0 {
+			sent, rejected, err := spool.send(batch)
+			if err != nil {
+				log.Debugln("Could not replay metrics", err.Error())
+				return false
+			}
+
+			replayed += sent
+			batchDropped += rejected
+		}
+
+		done += batchBytes
+		doneLines += batchLines
+		dropped += batchDropped
+		batch, batchBytes, batchLines, batchDropped = nil, 0, 0, 0
+		return true
+	}
+
+	// Only what's spooled so far, appends don't touch that part. Lines we
+	// can't read are dropped, they would block the spool for good.
+	failed := false
+	reader := bufio.NewReader(io.LimitReader(file, size))
+	for !failed {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			batchBytes += int64(len(line))
+			batchLines++
+
+			var point spoolPoint
+			if len(line) > spoolMaxLine || json.Unmarshal(line, &point) != nil || time.Since(point.Time) > spool.maxAge {
+				batchDropped++
+			} else {
+				batch = append(batch, point)
+			}
+
+			if len(batch) >= spoolReplayBatch && !flush() {
+				failed = true
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorln("Could not read metrics spool", err.Error())
+			break
+		}
+	}
+	file.Close()
+
+	if !failed {
+		flush()
+	}
+
+	if done == 0 {
+		return
+	}
+
+	spool.Lock()
+	defer spool.Unlock()
+
+	spool.dropped += dropped
+	spool.replayed += replayed
+
+	err = spool.truncate(done)
+	if err != nil {
+		log.Errorln("Could not rewrite metrics spool", err.Error())
+		return
+	}
+
+	spool.depth -= doneLines
+	spool.bytes -= done
+	if spool.depth == 0 {
+		log.Noteln("Replayed all spooled metrics")
+	}
+}
+
+// send writes spooled points to influx. A batch influx rejects for good is
+// sent point by point, so only the bad points are dropped.
+func (spool *spoolSink) send(points []spoolPoint) (int, int, error) {
+	err := spool.writer.write(points)
+	if err == nil {
+		return len(points), 0, nil
+	}
+
+	if _, ok := err.(influxRejected); !ok {
+		return 0, 0, err
+	}
+
+	if len(points) == 1 {
+		log.Errorln("Dropping spooled metric", points[0].Name+":", err.Error())
+		return 0, 1, nil
+	}
+
+	sent, rejected := 0, 0
+	for _, point := range points {
+		s, r, err := spool.send([]spoolPoint{point})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		sent += s
+		rejected += r
+	}
+
+	return sent, rejected, nil
+}
+
+// truncate removes the first bytes of the spool. What's left is written to
+// a new file, so a crash can't lose the spool. The spool lock has to be held.
+func (spool *spoolSink) truncate(offset int64) error {
+	file, err := os.Open(spool.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.Create(spool.path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, file)
+	tmp.Close()
+	if err != nil {
+		os.Remove(spool.path + ".tmp")
+		return err
+	}
+
+	return os.Rename(spool.path+".tmp", spool.path)
+}
+
+// stats returns the current state of the spool
+func (spool *spoolSink) stats() spoolStats {
+	spool.Lock()
+	defer spool.Unlock()
+
+	return spoolStats{
+		depth:    spool.depth,
+		bytes:    spool.bytes,
+		dropped:  spool.dropped,
+		replayed: spool.replayed,
+	}
+}
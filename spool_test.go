@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolReplayDropsRejected(t *testing.T) {
+	// Influx refuses the whole batch if one point is bad
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "bad") {
+			http.Error(w, "field type conflict", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool := &spoolSink{
+		writer:   newInfluxWriter(server.URL, "metrics", "", ""),
+		path:     filepath.Join(dir, "spool"),
+		maxBytes: 10 * 1024 * 1024,
+		maxAge:   time.Hour,
+	}
+
+	spool.Lock()
+	spool.append(newSpoolPoint("good", nil, map[string]interface{}{"count": 1}))
+	spool.append(newSpoolPoint("bad", nil, map[string]interface{}{"count": 2}))
+	spool.Unlock()
+
+	// A line that's no metric at all
+	file, err := os.OpenFile(spool.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := strings.Repeat("x", spoolMaxLine+1) + "\n"
+	file.WriteString(garbage)
+	file.Close()
+
+	spool.Lock()
+	spool.depth++
+	spool.bytes += int64(len(garbage))
+	spool.append(newSpoolPoint("good", nil, map[string]interface{}{"count": 3}))
+	spool.Unlock()
+
+	spool.replay()
+
+	stats := spool.stats()
+	if stats.depth != 0 || stats.bytes != 0 {
+		t.Errorf("depth %d, bytes %d left, want an empty spool", stats.depth, stats.bytes)
+	}
+	if stats.replayed != 2 {
+		t.Errorf("replayed %d, want 2", stats.replayed)
+	}
+	if stats.dropped != 2 {
+		t.Errorf("dropped %d, want 2", stats.dropped)
+	}
+}
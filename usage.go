@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Outcomes of a command, API call or job
+const (
+	outcomeSuccess  = "success"
+	outcomeDenied   = "denied"
+	outcomeUsage    = "usage"
+	outcomeInternal = "internal_error"
+	outcomeRetry    = "retry"
+)
+
+// usageKey identifies a series of usage metrics
+type usageKey struct {
+	metric  string
+	nameTag string
+	name    string
+	server  string
+	outcome string
+}
+
+// usageStat sums up all invocations of a series since the start
+type usageStat struct {
+	count       int
+	runSeconds  float64
+	waitSeconds float64
+}
+
+// recordUsage counts a single command, API call or job
+func (bot *AwakenBot) recordUsage(key usageKey, wait time.Duration, run time.Duration) {
+	if key.server == "" {
+		key.server = "global"
+	}
+
+	bot.usageMutex.Lock()
+	stat, ok := bot.usage[key]
+	if !ok {
+		stat = &usageStat{}
+		bot.usage[key] = stat
+	}
+	stat.count++
+	stat.runSeconds += run.Seconds()
+	stat.waitSeconds += wait.Seconds()
+	bot.usageMutex.Unlock()
+}
+
+// recordCommand counts a command dispatched by messageCreate
+func (bot *AwakenBot) recordCommand(command string, server string, outcome string, started time.Time) {
+	bot.recordUsage(usageKey{
+		metric:  "command_usage",
+		nameTag: "command",
+		name:    command,
+		server:  server,
+		outcome: outcome,
+	}, 0, time.Since(started))
+}
+
+// recordRequest counts a call of the HTTP API
+func (bot *AwakenBot) recordRequest(route string, guildID string, status int, started time.Time) {
+	outcome := outcomeSuccess
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		outcome = outcomeDenied
+	case status >= 500:
+		outcome = outcomeInternal
+	case status >= 400:
+		outcome = outcomeUsage
+	}
+
+	server := ""
+	if guild, err := bot.DG.State.Guild(guildID); guildID != "" && err == nil {
+		server = guild.Name
+	}
+
+	bot.recordUsage(usageKey{
+		metric:  "api_usage",
+		nameTag: "route",
+		name:    route,
+		server:  server,
+		outcome: outcome,
+	}, 0, time.Since(started))
+}
+
+// countRequests counts the requests of routes without an API key. Requests
+// that match no route are counted under a single name, their paths are
+// made up by the client.
+func (bot *AwakenBot) countRequests(handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		handler.ServeHTTP(recorder, r)
+
+		bot.recordRequest(r.Method+" "+routeName(r, "unmatched"), "", recorder.status, started)
+	}
+}
+
+// routeName returns the path template of the route a request matched
+func routeName(r *http.Request, fallback string) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return fallback
+}
+
+// recordJob counts a single attempt of a job
+func (bot *AwakenBot) recordJob(queued *queuedJob, server string, outcome string, started time.Time) {
+	bot.recordUsage(usageKey{
+		metric:  "job_timings",
+		nameTag: "jobType",
+		name:    queued.job.Type(),
+		server:  server,
+		outcome: outcome,
+	}, started.Sub(queued.queuedAt), time.Since(started))
+}
+
+// collectUsageMetrics sends the usage counters. They only ever grow, so
+// rates have to be calculated by the metrics backend.
+func (bot *AwakenBot) collectUsageMetrics() {
+	bot.usageMutex.Lock()
+	usage := make(map[usageKey]usageStat)
+	for key, stat := range bot.usage {
+		usage[key] = *stat
+	}
+	bot.usageMutex.Unlock()
+
+	for key, stat := range usage {
+		tags := map[string]string{"metric": key.metric, "server": key.server, key.nameTag: key.name, "outcome": key.outcome}
+		fields := map[string]interface{}{
+			"count":      stat.count,
+			"runSeconds": stat.runSeconds,
+		}
+		if key.metric == "job_timings" {
+			fields["waitSeconds"] = stat.waitSeconds
+		}
+
+		bot.addMetric("usage_metrics", tags, fields)
+	}
+}